@@ -5,19 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/jemgunay/life-metrics/influx"
+	"github.com/jemgunay/life-metrics/auth"
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/schema"
 	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+	"github.com/jemgunay/life-metrics/users"
 )
 
 // dayLogRequest represents a day log creation request body.
 type dayLogRequest struct {
-	Date    time.Time `json:"date"`
-	Metrics metrics   `json:"metrics"`
-	Notes   string    `json:"notes"`
+	Date    string                 `json:"date"`
+	Metrics map[string]interface{} `json:"metrics"`
+	Notes   string                 `json:"notes"`
+
+	// day is the start of the parsed date in the configured timezone
+	day time.Time
 }
 
 // dayLogResponse represents a day log data response.
@@ -27,49 +36,75 @@ type dayLogResponse struct {
 	Notes     string                 `json:"notes,omitempty"`
 }
 
-type metrics struct {
-	GeneralMood    int  `json:"general_mood"`
-	DietQuality    int  `json:"diet_quality"`
-	WaterIntake    int  `json:"water_intake"`
-	CaffeineIntake int  `json:"caffeine_intake"`
-	Exercise       bool `json:"exercise"`
-	Meditation     bool `json:"meditation"`
+// deleteResponse represents a soft day log deletion response, containing the revision to restore to undo the deletion.
+type deleteResponse struct {
+	RestoreRevision string `json:"restore_revision"`
 }
 
-// API defines the API handler entry point and access to influx.
+// API defines the API handler entry point and access to storage.
 type API struct {
-	influxRequester influx.Requester
+	store     storage.Store
+	schema    schema.Schema
+	locations map[string]*time.Location
+	// location is the timezone that the user's day logs are bucketed into days in, which is set by forUser
+	location *time.Location
+	// revisionMu serialises writing revisions, as each is written after the latest revision of its day
+	revisionMu *sync.Mutex
 }
 
-// New returns an initialised API.
-func New(influxRequester influx.Requester) API {
-	return API{
-		influxRequester: influxRequester,
+// New returns an initialised API which validates day logs against the provided schema. Each user's day logs are
+// bucketed into days in their location.
+func New(store storage.Store, daySchema schema.Schema, userList []users.User) API {
+	a := API{
+		store:      store,
+		schema:     daySchema,
+		locations:  make(map[string]*time.Location, len(userList)),
+		location:   time.UTC,
+		revisionMu: &sync.Mutex{},
+	}
+	for _, user := range userList {
+		a.locations[user.ID] = user.Location
 	}
+	return a
+}
+
+// forUser returns a copy of the API which only accesses the authenticated user's data, in the user's location.
+func (a API) forUser(r *http.Request) API {
+	return a.forUserID(auth.UserID(r.Context()))
+}
+
+// forUserID returns a copy of the API which only accesses the user's data, in the user's location.
+func (a API) forUserID(userID string) API {
+	a.store = a.store.ForUser(userID)
+	if loc, ok := a.locations[userID]; ok && loc != nil {
+		a.location = loc
+	}
+	return a
 }
 
 // Handler is the root HTTP API handler for submitting and reading day logs.
 func (a API) Handler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("request to API handler [%s] (%s) from %s", r.Method, r.URL, r.RemoteAddr)
+	logging.Debugf("request to API handler [%s] (%s) from %s", r.Method, r.URL, r.RemoteAddr)
+	a = a.forUser(r)
 
 	switch r.Method {
 	// get today's submitted day log data
 	case http.MethodGet:
-		date, err := extractDateQuery(r)
+		date, err := extractDateQuery(r, a.location)
 		if err != nil {
-			log.Printf("failed to process date query: %s", err)
+			logging.Errorf("failed to process date query: %s", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		data, err := a.influxRequester.ReadDayLog(date)
+		data, err := a.store.ReadDayLog(date)
 		if err != nil {
-			log.Printf("failed to query influx: %s", err)
+			logging.Errorf("failed to query storage: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// process influx data into response expected by the UI
+		// process stored data into response expected by the UI
 		dayLogResp := dayLogResponse{}
 		if len(data) > 0 {
 			dayLogResp.Submitted = true
@@ -83,7 +118,7 @@ func (a API) Handler(w http.ResponseWriter, r *http.Request) {
 
 		body, err := json.Marshal(dayLogResp)
 		if err != nil {
-			log.Printf("failed to JSON encode response: %s", err)
+			logging.Errorf("failed to JSON encode response: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -92,39 +127,72 @@ func (a API) Handler(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPost:
 		// submit today's day log data
-		logReq, err := decodeBody(r)
+		logReq, err := decodeBody(r, a.location)
 		if err != nil {
-			log.Printf("failed to process request body: %s", err)
+			logging.Errorf("failed to process request body: %s", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if err := a.processDayLog(logReq); err != nil {
-			log.Printf("failed to process request data: %s", err)
+		res, err := a.processDayLog(logReq)
+		if err != nil {
+			logging.Errorf("failed to process request data: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := a.writeDayLog(res); err != nil {
+			logging.Errorf("failed to write day log data to storage: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+	case http.MethodDelete:
+		// delete a date's day log data - soft deletes retain the day log's revisions so that it can be restored
+		date, err := extractDateQuery(r, a.location)
+		if err != nil {
+			logging.Errorf("failed to process date query: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		soft := r.URL.Query().Get("soft") == "true"
+
+		restoreRevision, err := a.deleteDayLog(date, soft)
+		if err != nil {
+			logging.Errorf("failed to delete day log: %s", err)
+			if errors.Is(err, errDayLogNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if soft {
+			body, err := json.Marshal(deleteResponse{RestoreRevision: restoreRevision})
+			if err != nil {
+				logging.Errorf("failed to JSON encode response: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write(body)
+		}
+
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func extractDateQuery(r *http.Request) (time.Time, error) {
-	date := r.URL.Query().Get("date")
-	if date == "" {
-		return time.Time{}, errors.New("no date query provided")
-	}
-
-	parsedDate, err := time.Parse(time.RFC3339, date)
+func extractDateQuery(r *http.Request, loc *time.Location) (time.Time, error) {
+	date, err := parseDate(r.URL.Query().Get("date"), loc)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to parse date as RFC3339: %s", err)
+		return time.Time{}, fmt.Errorf("invalid date query: %s", err)
 	}
 
-	return parsedDate, nil
+	return date, nil
 }
 
-func decodeBody(r *http.Request) (dayLogRequest, error) {
+func decodeBody(r *http.Request, loc *time.Location) (dayLogRequest, error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return dayLogRequest{}, fmt.Errorf("failed to read body: %s", err)
@@ -135,14 +203,32 @@ func decodeBody(r *http.Request) (dayLogRequest, error) {
 		return dayLogRequest{}, fmt.Errorf("failed to JSON decode body: %s", err)
 	}
 
-	if req.Date.IsZero() {
-		return dayLogRequest{}, fmt.Errorf("invalid date provided: %s", req.Date)
+	req.day, err = parseDate(req.Date, loc)
+	if err != nil {
+		return dayLogRequest{}, fmt.Errorf("invalid date provided: %s", err)
 	}
 
 	return req, nil
 }
 
-// fieldSet is used to store fields to be written to influx and is used to calculate the score for a day log.
+// SchemaHandler serves the day log schema, which the web app renders the day log form from.
+func (a API) SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(a.schema)
+	if err != nil {
+		logging.Errorf("failed to JSON encode schema: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(body)
+}
+
+// fieldSet is used to store fields to be written to storage and is used to calculate the score for a day log.
 type fieldSet struct {
 	fields     map[string]interface{}
 	scoreValue int
@@ -159,59 +245,111 @@ func newFieldSet(notes string) fieldSet {
 	}
 }
 
-// addInt adds an int field to the fieldSet, updating the score (maximum of 10).
-func (f *fieldSet) addInt(name string, value int) {
-	f.fields[name] = value
-	f.scoreValue += value
-	f.scoreMax += 10
-}
+// add validates a metric value against its schema definition and adds it to the fieldSet, updating the score.
+func (f *fieldSet) add(metric schema.Metric, value interface{}) error {
+	switch metric.Type {
+	case schema.TypeScale:
+		v, ok := value.(float64)
+		if !ok || v != math.Trunc(v) {
+			return fmt.Errorf("%s must be an integer", metric.Name)
+		}
+		if v < *metric.Min || v > *metric.Max {
+			return fmt.Errorf("%s must be between %v and %v", metric.Name, *metric.Min, *metric.Max)
+		}
+		// inverted scale values are stored inverted so that higher is always better
+		if metric.Inverted {
+			v = *metric.Max + *metric.Min - v
+		}
+		f.fields[metric.Name] = int(v)
+		f.addScore(metric.Weight, (v-*metric.Min)/(*metric.Max-*metric.Min))
 
-// addIntInvert subtracts the int from the max possible and adds the int field to the fieldSet, updating the score
-// (maximum of 10).
-func (f *fieldSet) addIntInvert(name string, value int) {
-	f.fields[name] = 10 - value
-	f.scoreValue += 10 - value
-	f.scoreMax += 10
-}
+	case schema.TypeNumber:
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s must be a number", metric.Name)
+		}
+		f.fields[metric.Name] = v
+		if metric.Min == nil {
+			return nil
+		}
+		if v < *metric.Min || v > *metric.Max {
+			return fmt.Errorf("%s must be between %v and %v", metric.Name, *metric.Min, *metric.Max)
+		}
+		ratio := (v - *metric.Min) / (*metric.Max - *metric.Min)
+		if metric.Inverted {
+			ratio = 1 - ratio
+		}
+		f.addScore(metric.Weight, ratio)
 
-// addBool adds a bool field to the fieldSet, updating the score (maps false/true to 0/5).
-func (f *fieldSet) addBool(name string, value bool) {
-	f.fields[name] = false
-	if value {
-		f.fields[name] = true
-		f.scoreValue += 5
+	case schema.TypeBool:
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s must be a bool", metric.Name)
+		}
+		f.fields[metric.Name] = v
+		var ratio float64
+		if v != metric.Inverted {
+			ratio = 1
+		}
+		f.addScore(metric.Weight, ratio)
+
+	case schema.TypeText:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", metric.Name)
+		}
+		f.fields[metric.Name] = v
+
+	default:
+		return fmt.Errorf("%s has unsupported type %s", metric.Name, metric.Type)
 	}
-	f.scoreMax += 5
+
+	return nil
+}
+
+// addScore adds the proportion (0 to 1) of the weight achieved by a metric to the score.
+func (f *fieldSet) addScore(weight int, ratio float64) {
+	f.scoreValue += int(math.Round(ratio * float64(weight)))
+	f.scoreMax += weight
 }
 
 // calcHealth calculates the health score from the total and max field scores and adds it to the fieldSet.
 func (f *fieldSet) calcHealth() {
 	f.fields["score_value"] = f.scoreValue
 	f.fields["score_max"] = f.scoreMax
-	f.fields["score_health"] = float64(f.scoreValue) / float64(f.scoreMax) * 100
+	if f.scoreMax > 0 {
+		f.fields["score_health"] = float64(f.scoreValue) / float64(f.scoreMax) * 100
+	}
 }
 
-// processDayLog processes the day log request into a result to be written to influx.
-func (a API) processDayLog(req dayLogRequest) error {
+// processDayLog validates the day log request against the schema and processes it into a result to be written to
+// storage.
+func (a API) processDayLog(req dayLogRequest) (sources.Result, error) {
 	res := newFieldSet(req.Notes)
 
 	// add all request fields to the result
-	res.addInt("general_mood", req.Metrics.GeneralMood)
-	res.addInt("diet_quality", req.Metrics.DietQuality)
-	res.addInt("water_intake", req.Metrics.WaterIntake)
-	res.addIntInvert("caffeine_intake", req.Metrics.CaffeineIntake)
-	res.addBool("exercise", req.Metrics.Exercise)
-	res.addBool("meditation", req.Metrics.Meditation)
+	for _, metric := range a.schema.Metrics {
+		value, ok := req.Metrics[metric.Name]
+		if !ok {
+			return sources.Result{}, fmt.Errorf("%s metric not provided", metric.Name)
+		}
+		if err := res.add(metric, value); err != nil {
+			return sources.Result{}, fmt.Errorf("invalid metric: %s", err)
+		}
+		delete(req.Metrics, metric.Name)
+	}
+	// any remaining metrics are not defined in the schema
+	if len(req.Metrics) > 0 {
+		unknown := make([]string, 0, len(req.Metrics))
+		for name := range req.Metrics {
+			unknown = append(unknown, name)
+		}
+		return sources.Result{}, fmt.Errorf("unknown metrics provided: %s", strings.Join(unknown, ", "))
+	}
 	res.calcHealth()
 
-	// aggregate tags and stringify values
-	logData := sources.Result{
-		Time:   req.Date,
+	return sources.Result{
+		Time:   req.day,
 		Fields: res.fields,
-	}
-
-	if err := a.influxRequester.Write("day_log", logData); err != nil {
-		return fmt.Errorf("failed to write day log data to influx: %s", err)
-	}
-	return nil
+	}, nil
 }
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/schema"
+)
+
+// baselineMetrics are the fixed day log metrics which were scored before the schema was introduced.
+type baselineMetrics struct {
+	GeneralMood    int
+	DietQuality    int
+	WaterIntake    int
+	CaffeineIntake int
+	Exercise       bool
+	Meditation     bool
+}
+
+// baselineFields reproduces the fields written by processDayLog before the schema was introduced, which the default
+// schema must continue to produce so that existing day logs and dashboards remain comparable.
+func baselineFields(m baselineMetrics) map[string]interface{} {
+	fields := map[string]interface{}{
+		"notes":           "notes",
+		"general_mood":    m.GeneralMood,
+		"diet_quality":    m.DietQuality,
+		"water_intake":    m.WaterIntake,
+		"caffeine_intake": 10 - m.CaffeineIntake,
+		"exercise":        m.Exercise,
+		"meditation":      m.Meditation,
+	}
+	scoreValue := m.GeneralMood + m.DietQuality + m.WaterIntake + 10 - m.CaffeineIntake
+	if m.Exercise {
+		scoreValue += 5
+	}
+	if m.Meditation {
+		scoreValue += 5
+	}
+	fields["score_value"] = scoreValue
+	fields["score_max"] = 50
+	fields["score_health"] = float64(scoreValue) / float64(50) * 100
+	return fields
+}
+
+func TestProcessDayLogMatchesBaseline(t *testing.T) {
+	a := New(nil, schema.Default(), nil)
+	day := time.Date(2021, 11, 7, 0, 0, 0, 0, time.UTC)
+
+	for scale := 0; scale <= 10; scale++ {
+		for caffeine := 0; caffeine <= 10; caffeine++ {
+			for _, exercise := range []bool{false, true} {
+				for _, meditation := range []bool{false, true} {
+					// vary each scale metric so that they can't be mixed up
+					m := baselineMetrics{
+						GeneralMood:    scale,
+						DietQuality:    10 - scale,
+						WaterIntake:    scale / 2,
+						CaffeineIntake: caffeine,
+						Exercise:       exercise,
+						Meditation:     meditation,
+					}
+					res, err := a.processDayLog(dayLogRequest{
+						Metrics: map[string]interface{}{
+							"general_mood":    float64(m.GeneralMood),
+							"diet_quality":    float64(m.DietQuality),
+							"water_intake":    float64(m.WaterIntake),
+							"caffeine_intake": float64(m.CaffeineIntake),
+							"exercise":        m.Exercise,
+							"meditation":      m.Meditation,
+						},
+						Notes: "notes",
+						day:   day,
+					})
+					if err != nil {
+						t.Fatalf("failed to process day log for %+v: %s", m, err)
+					}
+
+					if !res.Time.Equal(day) {
+						t.Errorf("day log time = %s, want %s", res.Time, day)
+					}
+					if _, ok := res.Fields["submission_date"].(time.Time); !ok {
+						t.Errorf("submission_date = %v, want a time", res.Fields["submission_date"])
+					}
+					delete(res.Fields, "submission_date")
+					if want := baselineFields(m); !reflect.DeepEqual(res.Fields, want) {
+						t.Fatalf("fields for %+v = %v, want %v", m, res.Fields, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestProcessDayLogCustomSchema(t *testing.T) {
+	float := func(f float64) *float64 {
+		return &f
+	}
+	a := New(nil, schema.Schema{
+		Metrics: []schema.Metric{
+			{Name: "sleep_hours", Type: schema.TypeNumber, Min: float(4), Max: float(9), Weight: 10},
+			{Name: "screen_time", Type: schema.TypeNumber, Min: float(0), Max: float(8), Inverted: true, Weight: 4},
+			{Name: "alcohol", Type: schema.TypeBool, Inverted: true, Weight: 5},
+			{Name: "stress", Type: schema.TypeScale, Min: float(1), Max: float(5), Inverted: true, Weight: 8},
+			{Name: "weight_kg", Type: schema.TypeNumber},
+			{Name: "highlight", Type: schema.TypeText},
+		},
+	}, nil)
+
+	res, err := a.processDayLog(dayLogRequest{
+		Metrics: map[string]interface{}{
+			"sleep_hours": 7.5,
+			"screen_time": 2.0,
+			"alcohol":     true,
+			"stress":      float64(2),
+			"weight_kg":   70.2,
+			"highlight":   "walk",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to process day log: %s", err)
+	}
+	delete(res.Fields, "submission_date")
+
+	// sleep scores 7 of 10 (3.5/5 rounded), screen time 3 of 4, alcohol 0 of 5 and the inverted stress of 2 is
+	// stored as 4, scoring 6 of 8
+	want := map[string]interface{}{
+		"notes":        "",
+		"sleep_hours":  7.5,
+		"screen_time":  2.0,
+		"alcohol":      true,
+		"stress":       4,
+		"weight_kg":    70.2,
+		"highlight":    "walk",
+		"score_value":  16,
+		"score_max":    27,
+		"score_health": float64(16) / float64(27) * 100,
+	}
+	if !reflect.DeepEqual(res.Fields, want) {
+		t.Errorf("fields = %v, want %v", res.Fields, want)
+	}
+}
+
+func TestProcessDayLogInvalid(t *testing.T) {
+	a := New(nil, schema.Default(), nil)
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"general_mood":    float64(7),
+			"diet_quality":    float64(3),
+			"water_intake":    float64(4),
+			"caffeine_intake": float64(0),
+			"exercise":        false,
+			"meditation":      true,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(m map[string]interface{})
+	}{
+		{name: "missing metric", modify: func(m map[string]interface{}) { delete(m, "general_mood") }},
+		{name: "unknown metric", modify: func(m map[string]interface{}) { m["sleep"] = float64(8) }},
+		{name: "above range", modify: func(m map[string]interface{}) { m["general_mood"] = float64(11) }},
+		{name: "below range", modify: func(m map[string]interface{}) { m["diet_quality"] = float64(-1) }},
+		{name: "fractional scale", modify: func(m map[string]interface{}) { m["water_intake"] = 4.5 }},
+		{name: "string scale", modify: func(m map[string]interface{}) { m["water_intake"] = "4" }},
+		{name: "non-bool", modify: func(m map[string]interface{}) { m["exercise"] = float64(1) }},
+	}
+
+	if _, err := a.processDayLog(dayLogRequest{Metrics: valid()}); err != nil {
+		t.Fatalf("failed to process valid day log: %s", err)
+	}
+	for _, test := range tests {
+		metrics := valid()
+		test.modify(metrics)
+		if _, err := a.processDayLog(dayLogRequest{Metrics: metrics}); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// dateLayout is the layout of local dates accepted and returned by the API.
+const dateLayout = "2006-01-02"
+
+// parseDate parses a local date (e.g. 2021-11-07) into the start of that day in the provided location. RFC3339
+// timestamps are also accepted, in which case the calendar date of the timestamp as written is used.
+func parseDate(date string, loc *time.Location) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, errors.New("no date provided")
+	}
+
+	parsedDate, err := time.Parse(dateLayout, date)
+	if err != nil {
+		parsedDate, err = time.Parse(time.RFC3339, date)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse date as %s or RFC3339: %s", dateLayout, date)
+		}
+	}
+
+	year, month, day := parsedDate.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+}
+
+// dayStart returns the start of the day containing the provided time in the provided location.
+func dayStart(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// formatDate formats the local date of the provided time.
+func formatDate(t time.Time) string {
+	return t.Format(dateLayout)
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+const (
+	defaultPageDays = 31
+	maxPageDays     = 366
+)
+
+// dayLogsResponse represents a page of day logs within a date range.
+type dayLogsResponse struct {
+	DayLogs     []dayLogEntry `json:"day_logs"`
+	MissingDays []string      `json:"missing_days"`
+	NextCursor  string        `json:"next_cursor,omitempty"`
+}
+
+// dayLogEntry represents a single submitted day log.
+type dayLogEntry struct {
+	Date           string                 `json:"date"`
+	Metrics        map[string]interface{} `json:"metrics"`
+	Notes          string                 `json:"notes"`
+	ScoreHealth    interface{}            `json:"score_health,omitempty"`
+	SubmissionDate interface{}            `json:"submission_date,omitempty"`
+}
+
+// DayLogsHandler serves the day logs submitted within a date range. Each page covers a number of days from the start
+// date (or cursor) and includes the days in that page which have no day log submitted.
+func (a API) DayLogsHandler(w http.ResponseWriter, r *http.Request) {
+	logging.Debugf("request to day logs handler [%s] (%s) from %s", r.Method, r.URL, r.RemoteAddr)
+	a = a.forUser(r)
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseDayLogsQuery(r, a.location)
+	if err != nil {
+		logging.Errorf("failed to process day logs query: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := a.readDayLogs(query)
+	if err != nil {
+		logging.Errorf("failed to read day logs: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logging.Errorf("failed to JSON encode response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(body)
+}
+
+// dayLogsQuery is a request for a page of day logs. All dates are the start of their respective days in the configured
+// timezone and end is inclusive.
+type dayLogsQuery struct {
+	start time.Time
+	end   time.Time
+	limit int
+}
+
+func parseDayLogsQuery(r *http.Request, loc *time.Location) (dayLogsQuery, error) {
+	q := r.URL.Query()
+
+	start, err := parseDate(q.Get("start"), loc)
+	if err != nil {
+		return dayLogsQuery{}, fmt.Errorf("invalid start query: %s", err)
+	}
+	end, err := parseDate(q.Get("end"), loc)
+	if err != nil {
+		return dayLogsQuery{}, fmt.Errorf("invalid end query: %s", err)
+	}
+
+	query := dayLogsQuery{
+		start: start,
+		end:   end,
+		limit: defaultPageDays,
+	}
+	if query.end.Before(query.start) {
+		return dayLogsQuery{}, errors.New("end is before start")
+	}
+
+	// the cursor is the first day of the next page
+	if cursor := q.Get("cursor"); cursor != "" {
+		cursorDate, err := parseDate(cursor, loc)
+		if err != nil {
+			return dayLogsQuery{}, fmt.Errorf("invalid cursor: %s", err)
+		}
+		if cursorDate.Before(query.start) || cursorDate.After(query.end) {
+			return dayLogsQuery{}, errors.New("cursor is outside of the requested range")
+		}
+		query.start = cursorDate
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		query.limit, err = strconv.Atoi(limit)
+		if err != nil || query.limit < 1 || query.limit > maxPageDays {
+			return dayLogsQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPageDays)
+		}
+	}
+
+	return query, nil
+}
+
+func (a API) readDayLogs(query dayLogsQuery) (dayLogsResponse, error) {
+	// determine the days covered by this page
+	pageEnd := query.start.AddDate(0, 0, query.limit)
+	resp := dayLogsResponse{
+		DayLogs:     []dayLogEntry{},
+		MissingDays: []string{},
+	}
+	if pageEnd.After(query.end) {
+		pageEnd = query.end.AddDate(0, 0, 1)
+	} else if pageEnd.Before(query.end.AddDate(0, 0, 1)) {
+		resp.NextCursor = formatDate(pageEnd)
+	}
+
+	results, err := a.store.ReadRange("day_log", sources.NewPeriod(query.start, pageEnd))
+	if err != nil {
+		return dayLogsResponse{}, fmt.Errorf("failed to query storage: %s", err)
+	}
+
+	// group results into days, with later results taking precedence
+	days := make(map[string]map[string]interface{})
+	for _, result := range results {
+		day := formatDate(dayStart(result.Time, query.start.Location()))
+		fields, ok := days[day]
+		if !ok {
+			fields = make(map[string]interface{}, len(result.Fields))
+			days[day] = fields
+		}
+		for k, v := range result.Fields {
+			fields[k] = v
+		}
+	}
+
+	for day := query.start; day.Before(pageEnd); day = day.AddDate(0, 0, 1) {
+		fields, ok := days[formatDate(day)]
+		if !ok {
+			resp.MissingDays = append(resp.MissingDays, formatDate(day))
+			continue
+		}
+		resp.DayLogs = append(resp.DayLogs, newDayLogEntry(day, fields))
+	}
+
+	return resp, nil
+}
+
+// newDayLogEntry separates the day log metrics from the other stored day log fields.
+func newDayLogEntry(day time.Time, fields map[string]interface{}) dayLogEntry {
+	entry := dayLogEntry{
+		Date:           formatDate(day),
+		Metrics:        make(map[string]interface{}, len(fields)),
+		ScoreHealth:    fields["score_health"],
+		SubmissionDate: fields["submission_date"],
+	}
+	if notes, ok := fields["notes"].(string); ok {
+		entry.Notes = notes
+	}
+
+	for k, v := range fields {
+		switch k {
+		case "notes", "score_health", "score_value", "score_max", "submission_date":
+			continue
+		}
+		entry.Metrics[k] = v
+	}
+
+	return entry
+}
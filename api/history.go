@@ -0,0 +1,384 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+// revisionMeasurement stores every submitted revision of a day log. Each revision stores its ID in the revision field
+// and is written a nanosecond after the previous revision of its day, so that revisions do not overwrite each other
+// without creating a series per revision. Revisions recorded before the ID was a field are tagged with their ID.
+const revisionMeasurement = "day_log_revision"
+
+// initialRevision is the revision listed for a day log submitted before revisions were recorded, which is the current
+// day log.
+const initialRevision = "initial"
+
+// historyResponse represents the revision history of a day log.
+type historyResponse struct {
+	Date      string          `json:"date"`
+	Revisions []revisionEntry `json:"revisions"`
+}
+
+// revisionEntry represents a single day log revision and the fields which changed from the previous revision.
+type revisionEntry struct {
+	Revision     string `json:"revision"`
+	RestoredFrom string `json:"restored_from,omitempty"`
+	Deleted      bool   `json:"deleted,omitempty"`
+	dayLogEntry
+	Changes []fieldChange `json:"changes"`
+}
+
+// fieldChange represents a field which differs between two revisions.
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// HistoryHandler lists the revisions of a day log and restores previous revisions.
+func (a API) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	logging.Debugf("request to history handler [%s] (%s) from %s", r.Method, r.URL, r.RemoteAddr)
+	a = a.forUser(r)
+
+	date, err := extractDateQuery(r, a.location)
+	if err != nil {
+		logging.Errorf("failed to process date query: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	// list the revisions for a day log
+	case http.MethodGet:
+		revisions, err := a.readRevisions(date)
+		if err != nil {
+			logging.Errorf("failed to read day log revisions: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.Marshal(historyResponse{
+			Date:      formatDate(date),
+			Revisions: revisions,
+		})
+		if err != nil {
+			logging.Errorf("failed to JSON encode response: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(body)
+
+	// restore a previous revision of a day log
+	case http.MethodPost:
+		revision := r.URL.Query().Get("revision")
+		if revision == "" {
+			logging.Warnf("no revision query provided")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := a.restoreRevision(date, revision); err != nil {
+			logging.Errorf("failed to restore day log revision: %s", err)
+			if errors.Is(err, errRevisionNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeDayLog writes a day log and records it as a new revision.
+func (a API) writeDayLog(res sources.Result) error {
+	if err := a.store.Write("day_log", res); err != nil {
+		return fmt.Errorf("failed to write day log: %s", err)
+	}
+	_, err := a.writeRevision(res.Time, res.Fields, "")
+	return err
+}
+
+// replaceDayLog replaces every point of the day log for the day starting at res.Time with res, recording it as a new
+// revision restored from the provided revision. The day log is never lost if a write or delete fails, as res is first
+// staged after the existing points, taking precedence over them while they are deleted, and is then moved to the start
+// of the day so that later submissions take precedence over it.
+func (a API) replaceDayLog(res sources.Result, restoredFrom string) error {
+	current, err := a.store.ReadRange("day_log", sources.NewPeriod(res.Time, res.Time.AddDate(0, 0, 1)))
+	if err != nil {
+		return fmt.Errorf("failed to query storage: %s", err)
+	}
+
+	staged := res
+	staged.Time = res.Time.Add(time.Nanosecond)
+	for _, point := range current {
+		if !point.Time.Before(staged.Time) {
+			staged.Time = point.Time.Add(time.Nanosecond)
+		}
+	}
+	if err := a.store.Write("day_log", staged); err != nil {
+		return fmt.Errorf("failed to write day log: %s", err)
+	}
+	if err := a.store.Delete("day_log", sources.NewPeriod(res.Time, staged.Time)); err != nil {
+		return fmt.Errorf("failed to clear day log: %s", err)
+	}
+	if err := a.store.Write("day_log", res); err != nil {
+		return fmt.Errorf("failed to write day log: %s", err)
+	}
+	if err := a.store.Delete("day_log", sources.NewPeriod(staged.Time, staged.Time.Add(time.Nanosecond))); err != nil {
+		return fmt.Errorf("failed to clear staged day log: %s", err)
+	}
+
+	_, err = a.writeRevision(res.Time, res.Fields, restoredFrom)
+	return err
+}
+
+// writeRevision records a revision of the day log for the provided day with a new revision ID, which is returned. If
+// the revision is a restored revision, the ID of that revision is recorded against the new revision.
+func (a API) writeRevision(day time.Time, fields map[string]interface{}, restoredFrom string) (string, error) {
+	a.revisionMu.Lock()
+	defer a.revisionMu.Unlock()
+
+	existing, err := a.store.ReadRange(revisionMeasurement, sources.NewPeriod(day, day.AddDate(0, 0, 1)))
+	if err != nil {
+		return "", fmt.Errorf("failed to query storage: %s", err)
+	}
+
+	id := newRevisionID()
+	revision := sources.Result{
+		Time:   day,
+		Fields: make(map[string]interface{}, len(fields)+2),
+	}
+	for _, res := range existing {
+		if !res.Time.Before(revision.Time) {
+			revision.Time = res.Time.Add(time.Nanosecond)
+		}
+	}
+	for k, v := range fields {
+		revision.Fields[k] = v
+	}
+	revision.Fields["revision"] = id
+	if restoredFrom != "" {
+		revision.Fields["restored_from"] = restoredFrom
+	}
+	if err := a.store.Write(revisionMeasurement, revision); err != nil {
+		return "", fmt.Errorf("failed to write day log revision: %s", err)
+	}
+
+	return id, nil
+}
+
+// newRevisionID generates a revision ID from the current time, which sorts in submission order.
+func newRevisionID() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// revisionID returns the ID of a stored revision.
+func revisionID(res sources.Result) string {
+	if id, ok := res.Fields["revision"].(string); ok {
+		return id
+	}
+	return res.Tags["revision"]
+}
+
+// sortRevisions sorts revisions by ID, which is in submission order.
+func sortRevisions(revisions []sources.Result) {
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisionID(revisions[i]) < revisionID(revisions[j])
+	})
+}
+
+// readRevisions reads all revisions of the day log for the provided day, oldest first.
+func (a API) readRevisions(day time.Time) ([]revisionEntry, error) {
+	period := sources.NewPeriod(day, day.AddDate(0, 0, 1))
+	results, err := a.store.ReadRange(revisionMeasurement, period)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage: %s", err)
+	}
+
+	// day logs submitted before revisions were recorded have no revisions, so treat the current day log as the first
+	if len(results) == 0 {
+		current, err := a.store.ReadRange("day_log", period)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query storage: %s", err)
+		}
+		for _, res := range current {
+			res.Fields["revision"] = initialRevision
+			results = append(results, res)
+		}
+	}
+	sortRevisions(results)
+
+	revisions := make([]revisionEntry, 0, len(results))
+	var previous map[string]interface{}
+	for _, res := range results {
+		id := revisionID(res)
+		restoredFrom, _ := res.Fields["restored_from"].(string)
+		deleted, _ := res.Fields["deleted"].(bool)
+		delete(res.Fields, "revision")
+		delete(res.Fields, "restored_from")
+		delete(res.Fields, "deleted")
+
+		revisions = append(revisions, revisionEntry{
+			Revision:     id,
+			RestoredFrom: restoredFrom,
+			Deleted:      deleted,
+			dayLogEntry:  newDayLogEntry(day, res.Fields),
+			Changes:      diffFields(previous, res.Fields),
+		})
+		previous = res.Fields
+	}
+
+	return revisions, nil
+}
+
+// diffFields determines the fields which differ between two revisions, excluding the submission date.
+func diffFields(previous, current map[string]interface{}) []fieldChange {
+	changes := []fieldChange{}
+	for field, value := range current {
+		if field == "submission_date" {
+			continue
+		}
+		if old, ok := previous[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes = append(changes, fieldChange{Field: field, Old: previous[field], New: value})
+		}
+	}
+	for field, old := range previous {
+		if _, ok := current[field]; !ok && field != "submission_date" {
+			changes = append(changes, fieldChange{Field: field, Old: old})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// restoreRevision replaces the day log for the provided day with a previous revision, recording the restore as a new
+// revision. Every current point of the day log is replaced so that fields missing from the revision are not kept from
+// the current day log.
+func (a API) restoreRevision(day time.Time, revision string) error {
+	period := sources.NewPeriod(day, day.AddDate(0, 0, 1))
+	revisions, err := a.store.ReadRange(revisionMeasurement, period)
+	if err != nil {
+		return fmt.Errorf("failed to query storage: %s", err)
+	}
+
+	// the initial revision listed for a day log without revisions is the current day log, so restoring it records
+	// the current day log as a revision
+	if revision == initialRevision && len(revisions) == 0 {
+		current, err := a.store.ReadRange("day_log", period)
+		if err != nil {
+			return fmt.Errorf("failed to query storage: %s", err)
+		}
+		if len(current) == 0 {
+			return fmt.Errorf("%w: %s", errRevisionNotFound, revision)
+		}
+		res := sources.Result{
+			Time:   day,
+			Fields: mergeFields(current),
+		}
+		res.Fields["submission_date"] = time.Now().UTC()
+		return a.replaceDayLog(res, initialRevision)
+	}
+
+	for _, res := range revisions {
+		if revisionID(res) != revision {
+			continue
+		}
+		if deleted, _ := res.Fields["deleted"].(bool); deleted {
+			return fmt.Errorf("%w: %s is a deletion", errRevisionNotFound, revision)
+		}
+
+		// revisions are offset from the start of the day, where the day log is written
+		res.Time = day
+		res.Tags = nil
+		res.Fields["submission_date"] = time.Now().UTC()
+		delete(res.Fields, "revision")
+		delete(res.Fields, "restored_from")
+		return a.replaceDayLog(res, revision)
+	}
+
+	return fmt.Errorf("%w: %s", errRevisionNotFound, revision)
+}
+
+// mergeFields merges the fields of a day log's points, where later points take precedence as when the day log is read.
+func mergeFields(points []sources.Result) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, point := range points {
+		for k, v := range point.Fields {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+var errDayLogNotFound = errors.New("day log not found")
+
+// deleteDayLog deletes the day log for the provided day. A soft delete records the deletion as a revision so that the
+// day log can be restored from its history, returning the revision to restore. A hard delete also deletes the history.
+func (a API) deleteDayLog(day time.Time, soft bool) (string, error) {
+	period := sources.NewPeriod(day, day.AddDate(0, 0, 1))
+	current, err := a.store.ReadRange("day_log", period)
+	if err != nil {
+		return "", fmt.Errorf("failed to query storage: %s", err)
+	}
+	if len(current) == 0 {
+		return "", errDayLogNotFound
+	}
+
+	if !soft {
+		if err := a.store.Delete("day_log", period); err != nil {
+			return "", fmt.Errorf("failed to delete day log: %s", err)
+		}
+		if err := a.store.Delete(revisionMeasurement, period); err != nil {
+			return "", fmt.Errorf("failed to delete day log revisions: %s", err)
+		}
+		return "", nil
+	}
+
+	// ensure the deleted day log is captured as a revision, e.g. if it was submitted before revisions were recorded
+	revisions, err := a.store.ReadRange(revisionMeasurement, period)
+	if err != nil {
+		return "", fmt.Errorf("failed to query storage: %s", err)
+	}
+	var restoreRevision string
+	if len(revisions) > 0 {
+		sortRevisions(revisions)
+		restoreRevision = revisionID(revisions[len(revisions)-1])
+	} else {
+		restoreRevision, err = a.writeRevision(day, mergeFields(current), "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := a.store.Delete("day_log", period); err != nil {
+		return "", fmt.Errorf("failed to delete day log: %s", err)
+	}
+
+	deletion := map[string]interface{}{
+		"deleted":         true,
+		"submission_date": time.Now().UTC(),
+	}
+	if _, err := a.writeRevision(day, deletion, ""); err != nil {
+		return "", err
+	}
+
+	return restoreRevision, nil
+}
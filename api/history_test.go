@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/disk"
+	"github.com/jemgunay/life-metrics/schema"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+var historyDay = time.Date(2021, 11, 7, 0, 0, 0, 0, time.UTC)
+
+// failingStore fails writes to the failing measurement while it is set.
+type failingStore struct {
+	storage.Store
+	failing string
+}
+
+func (s *failingStore) Write(measurement string, results ...sources.Result) error {
+	if measurement == s.failing {
+		return errors.New("storage unavailable")
+	}
+	return s.Store.Write(measurement, results...)
+}
+
+func newHistoryTestAPI(t *testing.T) (API, *failingStore, func()) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	d, err := disk.New(filepath.Join(dir, "life-metrics.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	store := &failingStore{Store: d}
+	return New(store, schema.Default(), nil), store, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// submitDayLog writes a day log with the provided general mood.
+func submitDayLog(t *testing.T, a API, mood int) {
+	res, err := a.processDayLog(dayLogRequest{
+		Metrics: map[string]interface{}{
+			"general_mood":    float64(mood),
+			"diet_quality":    float64(5),
+			"water_intake":    float64(5),
+			"caffeine_intake": float64(5),
+			"exercise":        false,
+			"meditation":      false,
+		},
+		day: historyDay,
+	})
+	if err != nil {
+		t.Fatalf("failed to process day log: %s", err)
+	}
+	if err := a.writeDayLog(res); err != nil {
+		t.Fatalf("failed to write day log: %s", err)
+	}
+}
+
+func readMood(t *testing.T, a API) string {
+	dayLog, err := a.store.ReadDayLog(historyDay)
+	if err != nil {
+		t.Fatalf("failed to read day log: %s", err)
+	}
+	return fmt.Sprint(dayLog["general_mood"])
+}
+
+func TestRevisions(t *testing.T) {
+	a, _, cleanup := newHistoryTestAPI(t)
+	defer cleanup()
+
+	submitDayLog(t, a, 3)
+	submitDayLog(t, a, 8)
+
+	revisions, err := a.readRevisions(historyDay)
+	if err != nil {
+		t.Fatalf("failed to read revisions: %s", err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision == revisions[1].Revision {
+		t.Fatalf("revisions = %+v, want 2 distinct revisions", revisions)
+	}
+
+	// revision IDs are stored as a field rather than as a tag, and each is offset from the previous revision
+	stored, err := a.store.ReadRange(revisionMeasurement, sources.NewPeriod(historyDay, historyDay.AddDate(0, 0, 1)))
+	if err != nil {
+		t.Fatalf("failed to read stored revisions: %s", err)
+	}
+	for i, res := range stored {
+		if _, ok := res.Tags["revision"]; ok {
+			t.Errorf("stored revision %d has a revision tag", i)
+		}
+		if want := historyDay.Add(time.Duration(i)); !res.Time.Equal(want) {
+			t.Errorf("stored revision %d time = %s, want %s", i, res.Time, want)
+		}
+	}
+
+	if err := a.restoreRevision(historyDay, revisions[0].Revision); err != nil {
+		t.Fatalf("failed to restore revision: %s", err)
+	}
+	if mood := readMood(t, a); mood != "3" {
+		t.Errorf("general_mood after restoring = %s, want 3", mood)
+	}
+	current, err := a.store.ReadRange("day_log", sources.NewPeriod(historyDay, historyDay.AddDate(0, 0, 1)))
+	if err != nil {
+		t.Fatalf("failed to read day log: %s", err)
+	}
+	if len(current) != 1 || !current[0].Time.Equal(historyDay) {
+		t.Errorf("day log points after restoring = %+v, want a single point at the start of the day", current)
+	}
+
+	revisions, err = a.readRevisions(historyDay)
+	if err != nil {
+		t.Fatalf("failed to read revisions: %s", err)
+	}
+	if len(revisions) != 3 || revisions[2].RestoredFrom != revisions[0].Revision {
+		t.Errorf("revisions after restoring = %+v, want a third revision restored from the first", revisions)
+	}
+
+	// later submissions take precedence over the restored day log
+	submitDayLog(t, a, 6)
+	if mood := readMood(t, a); mood != "6" {
+		t.Errorf("general_mood after submitting = %s, want 6", mood)
+	}
+}
+
+func TestRestoreRevisionWriteFailure(t *testing.T) {
+	a, store, cleanup := newHistoryTestAPI(t)
+	defer cleanup()
+
+	submitDayLog(t, a, 3)
+	submitDayLog(t, a, 8)
+	revisions, err := a.readRevisions(historyDay)
+	if err != nil {
+		t.Fatalf("failed to read revisions: %s", err)
+	}
+
+	// the current day log is kept if the restored day log can't be written
+	store.failing = "day_log"
+	if err := a.restoreRevision(historyDay, revisions[0].Revision); err == nil {
+		t.Fatal("expected restoring to fail")
+	}
+	if mood := readMood(t, a); mood != "8" {
+		t.Errorf("general_mood after a failed restore = %s, want 8", mood)
+	}
+}
+
+func TestSoftDeleteLegacyDayLog(t *testing.T) {
+	a, _, cleanup := newHistoryTestAPI(t)
+	defer cleanup()
+
+	// a day log submitted before revisions were recorded, which was updated by a later point
+	points := []sources.Result{
+		{Time: historyDay, Fields: map[string]interface{}{"general_mood": 3, "notes": "walk"}},
+		{Time: historyDay.Add(time.Hour), Fields: map[string]interface{}{"general_mood": 7}},
+	}
+	if err := a.store.Write("day_log", points...); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	revision, err := a.deleteDayLog(historyDay, true)
+	if err != nil {
+		t.Fatalf("failed to delete day log: %s", err)
+	}
+	if dayLog, err := a.store.ReadDayLog(historyDay); err != nil || len(dayLog) != 0 {
+		t.Fatalf("day log after deleting = %v, %v, want none", dayLog, err)
+	}
+
+	// every point of the deleted day log is restored
+	if err := a.restoreRevision(historyDay, revision); err != nil {
+		t.Fatalf("failed to restore revision: %s", err)
+	}
+	dayLog, err := a.store.ReadDayLog(historyDay)
+	if err != nil {
+		t.Fatalf("failed to read day log: %s", err)
+	}
+	if fmt.Sprint(dayLog["general_mood"]) != "7" || dayLog["notes"] != "walk" {
+		t.Errorf("day log after restoring = %v, want the general_mood 7 and notes walk", dayLog)
+	}
+}
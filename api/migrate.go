@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+// MigrateUTCDayLogs moves the user's day logs and their revisions which are stored at UTC midnight, as day logs were
+// before they were bucketed into days in the user's timezone, to the start of the same date in the user's timezone.
+// Otherwise, they fall into the previous day for timezones behind UTC, and take precedence over later submissions for
+// the same day for timezones ahead of UTC. It returns the number of points moved.
+func (a API) MigrateUTCDayLogs(userID string) (int, error) {
+	a = a.forUserID(userID)
+
+	var moved int
+	period := sources.NewPeriod(time.Unix(0, 0).UTC(), time.Now().UTC().AddDate(1, 0, 0))
+	for _, measurement := range []string{"day_log", revisionMeasurement} {
+		results, err := a.store.ReadRange(measurement, period)
+		if err != nil {
+			return moved, fmt.Errorf("failed to query storage: %s", err)
+		}
+
+		// points are grouped by time, as every point at the time is deleted at once, e.g. all of a day's revisions
+		legacy := make(map[time.Time][]sources.Result)
+		for _, res := range results {
+			t := res.Time.UTC()
+			year, month, day := t.Date()
+			// a point at the start of the day in the timezone can only be at UTC midnight if the timezone is UTC at
+			// that time, in which case it needn't be moved
+			localDay := time.Date(year, month, day, 0, 0, 0, 0, a.location)
+			if !t.Equal(time.Date(year, month, day, 0, 0, 0, 0, time.UTC)) || t.Equal(localDay) {
+				continue
+			}
+			res.Time = localDay
+			legacy[t] = append(legacy[t], res)
+		}
+
+		for t, group := range legacy {
+			// write before deleting so that an interrupted migration leaves duplicates rather than losing points
+			if err := a.store.Write(measurement, group...); err != nil {
+				return moved, fmt.Errorf("failed to write migrated %s: %s", measurement, err)
+			}
+			if err := a.store.Delete(measurement, sources.NewPeriod(t, t.Add(time.Nanosecond))); err != nil {
+				return moved, fmt.Errorf("failed to delete migrated %s: %s", measurement, err)
+			}
+			moved += len(group)
+		}
+	}
+	return moved, nil
+}
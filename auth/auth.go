@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jemgunay/life-metrics/config"
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/users"
+)
+
+// SessionCookie is the cookie which holds the signed web app session, which identifies the logged in user.
+const SessionCookie = "life_metrics_session"
+
+type contextKey struct{}
+
+// WithUserID returns a copy of the context which carries the authenticated user's ID.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, userID)
+}
+
+// UserID returns the ID of the authenticated user carried by the context, or the default user's ID if there is none.
+func UserID(ctx context.Context) string {
+	userID, _ := ctx.Value(contextKey{}).(string)
+	return userID
+}
+
+// Authenticator authenticates API requests as a user, either via an API token for machine callers or via a session
+// cookie for the web app.
+type Authenticator struct {
+	signer         *Signer
+	users          map[string]users.User
+	sessionTTL     time.Duration
+	secureCookies  bool
+	allowedOrigins map[string]bool
+	metricsToken   string
+}
+
+// NewAuthenticator initialises an Authenticator for the provided users which signs sessions with the provided signer.
+func NewAuthenticator(conf config.Config, signer *Signer, userList []users.User) *Authenticator {
+	a := &Authenticator{
+		signer:         signer,
+		users:          make(map[string]users.User, len(userList)),
+		sessionTTL:     conf.Auth.SessionTTL,
+		secureCookies:  strings.HasPrefix(conf.ServiceHost, "https://"),
+		allowedOrigins: make(map[string]bool, len(conf.Auth.AllowedOrigins)),
+		metricsToken:   conf.Auth.MetricsToken,
+	}
+	for _, user := range userList {
+		a.users[user.ID] = user
+	}
+	for _, origin := range conf.Auth.AllowedOrigins {
+		a.allowedOrigins[strings.TrimSuffix(origin, "/")] = true
+	}
+	return a
+}
+
+// Enabled determines whether authentication is enabled, which requires a user to have API tokens or a password set.
+func (a *Authenticator) Enabled() bool {
+	for _, user := range a.users {
+		if user.Password != "" || len(user.APITokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// multiUser determines whether users are defined in place of the default user.
+func (a *Authenticator) multiUser() bool {
+	_, ok := a.users[users.DefaultID]
+	return !ok
+}
+
+// AllowedOrigin determines whether the origin is allowed to make cross-origin requests.
+func (a *Authenticator) AllowedOrigin(origin string) bool {
+	return a.allowedOrigins[origin]
+}
+
+// Middleware rejects requests to the handlers that it wraps unless they are authenticated. The authenticated user's ID
+// is added to the request context.
+func (a *Authenticator) Middleware(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			f(w, r.WithContext(WithUserID(r.Context(), users.DefaultID)))
+			return
+		}
+
+		if header := r.Header.Get("Authorization"); header != "" {
+			userID, ok := a.apiTokenUser(strings.TrimPrefix(header, "Bearer "))
+			if !ok {
+				logging.Warnf("rejected request to %s from %s: invalid API token", r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			f(w, r.WithContext(WithUserID(r.Context(), userID)))
+			return
+		}
+
+		userID, ok := a.sessionUser(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// session cookies are sent by browsers on cross-site requests, so reject state changing requests which were
+		// not made by the web app
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" && !a.AllowedOrigin(origin) {
+				logging.Warnf("rejected %s request to %s from origin %s", r.Method, r.URL.Path, origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		f(w, r.WithContext(WithUserID(r.Context(), userID)))
+	}
+}
+
+// MetricsMiddleware rejects requests to the handler that it wraps unless they carry the metrics token, as metrics
+// cover every user rather than the authenticated user. If no metrics token is set, the handler is only served if
+// authentication is disabled.
+func (a *Authenticator) MetricsMiddleware(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.metricsToken == "" {
+			if a.Enabled() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f(w, r)
+			return
+		}
+
+		if !equal(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), a.metricsToken) {
+			logging.Warnf("rejected request to %s from %s: invalid metrics token", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// apiTokenUser returns the ID of the user that the API token belongs to. Every token is compared so that the time
+// taken does not depend on which token matched.
+func (a *Authenticator) apiTokenUser(token string) (string, bool) {
+	var userID string
+	var valid bool
+	for _, user := range a.users {
+		for _, apiToken := range user.APITokens {
+			if equal(token, apiToken) {
+				userID, valid = user.ID, true
+			}
+		}
+	}
+	return userID, valid
+}
+
+// sessionUser returns the ID of the user logged in by the request's session cookie.
+func (a *Authenticator) sessionUser(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", false
+	}
+	userID, err := a.signer.Verify(PurposeSession, cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	// the user may have been removed since logging in
+	_, ok := a.users[userID]
+	return userID, ok
+}
+
+type loginRequest struct {
+	// User is the ID of the user to log in as, which is omitted for the default user.
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	Enabled       bool   `json:"enabled"`
+	MultiUser     bool   `json:"multi_user"`
+	Authenticated bool   `json:"authenticated"`
+	User          string `json:"user,omitempty"`
+}
+
+// SessionHandler reports whether the request has a valid session and for which user (GET), logs in as a user with
+// their password (POST) or logs out (DELETE).
+func (a *Authenticator) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userID, ok := a.sessionUser(r)
+		resp := sessionResponse{
+			Enabled:       a.Enabled(),
+			MultiUser:     a.multiUser(),
+			Authenticated: !a.Enabled() || ok,
+			User:          userID,
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			logging.Errorf("failed to JSON encode session response: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case http.MethodPost:
+		if origin := r.Header.Get("Origin"); origin != "" && !a.AllowedOrigin(origin) {
+			logging.Warnf("rejected login from origin %s", origin)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req loginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			logging.Errorf("failed to JSON decode login request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// users without a password can't log in
+		user, ok := a.users[req.User]
+		if !ok || user.Password == "" || !equal(req.Password, user.Password) {
+			logging.Warnf("failed login as user %q from %s", req.User, r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		a.setSessionCookie(w, a.signer.Sign(PurposeSession, user.ID, a.sessionTTL), int(a.sessionTTL.Seconds()))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		a.setSessionCookie(w, "", -1)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// setSessionCookie sets the session cookie. When served over HTTPS, the cookie is sent on cross-site requests so that
+// a web app hosted on another site can use it.
+func (a *Authenticator) setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.secureCookies {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+}
+
+// equal compares secrets in constant time, hashing them first so that their lengths are not leaked.
+func equal(a, b string) bool {
+	aHash, bHash := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(aHash[:], bHash[:]) == 1
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature indicates that a signed value is malformed or was not signed by the Signer.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired indicates that a signed value has expired.
+	ErrExpired = errors.New("signature expired")
+)
+
+// Purposes that values are signed for. A value signed for one purpose can't be verified for another, e.g. an OAuth
+// state value can't be used as a session.
+const (
+	PurposeSession    = "session"
+	PurposeOAuthState = "oauth_state"
+)
+
+// Signer signs values with an expiry using HMAC-SHA256, so that they can be handed to clients and later verified,
+// e.g. OAuth state values.
+type Signer struct {
+	key []byte
+}
+
+// NewSigner initialises a Signer with a key derived from the provided secret. If the secret is empty, a random key is
+// generated, meaning that signed values can't be verified after a restart.
+func NewSigner(secret string) (*Signer, error) {
+	if secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate random key: %s", err)
+		}
+		return &Signer{key: key}, nil
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	return &Signer{key: key[:]}, nil
+}
+
+// Sign signs the value for the purpose, which is valid until the ttl has elapsed. The value is encoded in the result
+// but is not encrypted.
+func (s *Signer) Sign(purpose, value string, ttl time.Duration) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return payload + "." + s.mac(purpose, payload)
+}
+
+// Verify verifies a value produced by Sign for the same purpose, returning the original value if it is valid and has
+// not expired.
+func (s *Signer) Verify(purpose, signed string) (string, error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", ErrInvalidSignature
+	}
+	payload, mac := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(s.mac(purpose, payload))) {
+		return "", ErrInvalidSignature
+	}
+
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidSignature
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if time.Now().Unix() > expiry {
+		return "", ErrExpired
+	}
+
+	return string(value), nil
+}
+
+// mac authenticates the payload along with the purpose, which isn't included in the payload as it is known by the
+// verifier.
+func (s *Signer) mac(purpose, payload string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(purpose + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// RandomToken generates a random URL safe token, e.g. for nonces.
+func RandomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
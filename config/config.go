@@ -1,67 +1,432 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/jemgunay/life-metrics/logging"
 )
 
 // Config is the service config.
 type Config struct {
-	Port        int
-	WebAppHost  string
-	ServiceHost string
-	Influx      Influx
-	Monzo       Monzo
+	Port        int    `yaml:"port"`
+	WebAppHost  string `yaml:"web_app_host"`
+	ServiceHost string `yaml:"service_host"`
+	// Timezone is the IANA timezone that day logs are bucketed into days in, e.g. Europe/London.
+	Timezone string `yaml:"timezone"`
+	// SchemaPath is the YAML day log schema file - the default schema is used if unset.
+	SchemaPath string `yaml:"schema_path"`
+	// ShutdownTimeout is the deadline for in progress requests, collections and writes to complete on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// LogLevel is the minimum level of the messages which are logged, i.e. debug, info, warn or error.
+	LogLevel  string    `yaml:"log_level"`
+	Auth      Auth      `yaml:"auth"`
+	Storage   Storage   `yaml:"storage"`
+	Scheduler Scheduler `yaml:"scheduler"`
+	Influx    Influx    `yaml:"influx"`
+	Monzo     Monzo     `yaml:"monzo"`
+}
+
+// Auth contains the API authentication config. Authentication is disabled if neither API tokens nor a password are
+// set and there is no users file.
+type Auth struct {
+	// UsersPath is the YAML file defining the users - the API tokens and password are used by a single default user
+	// if unset.
+	UsersPath string `yaml:"users_path"`
+	// Secret is the secret values handed to clients are signed with, e.g. sessions and OAuth state values.
+	Secret string `yaml:"secret"`
+	// APITokens are the bearer tokens accepted from machine callers, e.g. a scheduler triggering collections.
+	APITokens []string `yaml:"api_tokens"`
+	// Password is the web app login password - session login is disabled if unset.
+	Password string `yaml:"password"`
+	// SessionTTL is the time a web app session remains valid for after logging in.
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// AllowedOrigins are the origins allowed to make cross-origin requests, which defaults to the web app host.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// MetricsToken is the bearer token the metrics endpoint is scraped with - the endpoint is disabled if unset, unless
+	// authentication is disabled.
+	MetricsToken string `yaml:"metrics_token"`
+}
+
+// Storage backends which can be selected via the Storage config.
+const (
+	StorageBackendInflux = "influx"
+	StorageBackendDisk   = "disk"
+)
+
+// Storage contains the storage backend config.
+type Storage struct {
+	Backend string `yaml:"backend"`
+	// Path is the file used by the disk storage backend.
+	Path string `yaml:"path"`
+	// OutboxDir is the directory failed source writes are spooled to before being retried.
+	OutboxDir string `yaml:"outbox_dir"`
+	// TokenDir is the directory source OAuth tokens are persisted to.
+	TokenDir string `yaml:"token_dir"`
+	// TokenSecret is the secret source OAuth tokens are encrypted with - tokens are not persisted if unset.
+	TokenSecret string `yaml:"token_secret"`
+}
+
+// Scheduler contains the collection scheduler config.
+type Scheduler struct {
+	// Jitter is the maximum random delay added to each scheduled collection.
+	Jitter time.Duration `yaml:"jitter"`
+	// JobHistoryPath is the file the recent collection jobs are persisted to.
+	JobHistoryPath string `yaml:"job_history_path"`
 }
 
 // Influx contains the InfluxDB config.
 type Influx struct {
-	Host  string
-	Token string
-	Org   string
+	Host  string `yaml:"host"`
+	Token string `yaml:"token"`
+	Org   string `yaml:"org"`
 }
 
 // Monzo contains the Monzo source config.
 type Monzo struct {
-	ClientID     string
-	ClientSecret string
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// APIURL and AuthURL are the Monzo API and auth base URLs, which can be pointed at a stand-in server for testing.
+	APIURL  string `yaml:"api_url"`
+	AuthURL string `yaml:"auth_url"`
+	// HTTPClient is the client used for Monzo requests - a default client with a 10 second timeout is used if nil.
+	HTTPClient *http.Client `yaml:"-"`
+	// Schedule is the interval or cron expression Monzo is automatically collected on - "off" disables it.
+	Schedule string `yaml:"schedule"`
+	// CollectTimeout is the deadline for each Monzo collection.
+	CollectTimeout time.Duration `yaml:"collect_timeout"`
+	// Categories is the allow list of transaction categories to store - all categories are stored if empty.
+	Categories []string `yaml:"categories"`
+	// ExcludedCategories is the deny list of transaction categories which are never stored.
+	ExcludedCategories []string `yaml:"excluded_categories"`
+	// Accounts is the allow list of account IDs or types (e.g. uk_retail_joint) to collect - all accounts are
+	// collected if empty.
+	Accounts []string `yaml:"accounts"`
+	// WebhookSecret is the secret token which verifies webhook requests - webhooks are disabled if unset.
+	WebhookSecret string `yaml:"webhook_secret"`
 }
 
-// New initialises a Config from environment variables.
-func New() Config {
-	// attempt to get config environment vars, or default them
+// Default returns the default config.
+func Default() Config {
 	return Config{
-		Port:        getEnvVarInt("PORT", 8080),
-		WebAppHost:  getEnvVar("WEB_APP_HOST", "http://localhost:8081"),
-		ServiceHost: getEnvVar("SERVICE_HOST", "http://localhost:8080"),
+		Port:        8080,
+		WebAppHost:  "http://localhost:8081",
+		ServiceHost: "http://localhost:8080",
+		Timezone:    "UTC",
+		// Cloud Run allows 10 seconds between SIGTERM and SIGKILL
+		ShutdownTimeout: time.Second * 9,
+		LogLevel:        "info",
+		Auth: Auth{
+			SessionTTL: time.Hour * 24 * 30,
+		},
+		Storage: Storage{
+			Backend:   StorageBackendInflux,
+			Path:      "data/life-metrics.db",
+			OutboxDir: "data/outbox",
+			TokenDir:  "data/tokens",
+		},
 		Influx: Influx{
-			Host:  getEnvVar("INFLUX_HOST", "http://localhost:8086"),
-			Token: getEnvVar("INFLUX_TOKEN", ""),
-			Org:   getEnvVar("INFLUX_ORG", ""),
+			Host: "http://localhost:8086",
+		},
+		Scheduler: Scheduler{
+			Jitter:         time.Minute * 5,
+			JobHistoryPath: "data/jobs.json",
 		},
 		Monzo: Monzo{
-			ClientID:     getEnvVar("MONZO_CLIENT_ID", ""),
-			ClientSecret: getEnvVar("MONZO_CLIENT_SECRET", ""),
+			APIURL:         "https://api.monzo.com",
+			AuthURL:        "https://auth.monzo.com",
+			Schedule:       "@every 6h",
+			CollectTimeout: time.Minute * 5,
 		},
 	}
 }
 
-// getEnvVar gets a string environment variable or defaults it if unset.
-func getEnvVar(key, defaultValue string) string {
+// New initialises a Config from the defaults, overridden by the YAML or JSON config file at path if provided, which
+// are in turn overridden by environment variables. Secrets can instead be read from the file named by the environment
+// var with a _FILE suffix, e.g. INFLUX_TOKEN_FILE. The resulting config is validated.
+func New(path string) (Config, error) {
+	conf := Default()
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %s", err)
+		}
+		// JSON is valid YAML, so both are decoded as YAML
+		if err := yaml.UnmarshalStrict(b, &conf); err != nil {
+			return Config{}, fmt.Errorf("failed to decode config file %s: %s", path, err)
+		}
+		logging.Infof("loaded config file %s", path)
+	}
+
+	if err := conf.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if len(conf.Auth.AllowedOrigins) == 0 {
+		conf.Auth.AllowedOrigins = []string{conf.WebAppHost}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return Config{}, err
+	}
+	return conf, nil
+}
+
+// applyEnv overrides config values with the environment variables which are set.
+func (c *Config) applyEnv() error {
+	env := &envOverrides{}
+	env.int("PORT", &c.Port)
+	env.string("WEB_APP_HOST", &c.WebAppHost)
+	env.string("SERVICE_HOST", &c.ServiceHost)
+	env.string("TIMEZONE", &c.Timezone)
+	env.string("SCHEMA_PATH", &c.SchemaPath)
+	env.duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	env.string("LOG_LEVEL", &c.LogLevel)
+
+	env.string("USERS_PATH", &c.Auth.UsersPath)
+	env.secret("AUTH_SECRET", &c.Auth.Secret)
+	env.secretList("API_TOKENS", &c.Auth.APITokens)
+	env.secret("WEB_APP_PASSWORD", &c.Auth.Password)
+	env.duration("SESSION_TTL", &c.Auth.SessionTTL)
+	env.list("ALLOWED_ORIGINS", &c.Auth.AllowedOrigins)
+	env.secret("METRICS_TOKEN", &c.Auth.MetricsToken)
+
+	env.string("STORAGE_BACKEND", &c.Storage.Backend)
+	env.string("STORAGE_PATH", &c.Storage.Path)
+	env.string("OUTBOX_DIR", &c.Storage.OutboxDir)
+	env.string("TOKEN_DIR", &c.Storage.TokenDir)
+	env.secret("TOKEN_SECRET", &c.Storage.TokenSecret)
+
+	env.duration("SCHEDULE_JITTER", &c.Scheduler.Jitter)
+	env.string("JOB_HISTORY_PATH", &c.Scheduler.JobHistoryPath)
+
+	env.string("INFLUX_HOST", &c.Influx.Host)
+	env.secret("INFLUX_TOKEN", &c.Influx.Token)
+	env.string("INFLUX_ORG", &c.Influx.Org)
+
+	env.string("MONZO_CLIENT_ID", &c.Monzo.ClientID)
+	env.secret("MONZO_CLIENT_SECRET", &c.Monzo.ClientSecret)
+	env.string("MONZO_API_URL", &c.Monzo.APIURL)
+	env.string("MONZO_AUTH_URL", &c.Monzo.AuthURL)
+	env.string("MONZO_SCHEDULE", &c.Monzo.Schedule)
+	env.duration("MONZO_COLLECT_TIMEOUT", &c.Monzo.CollectTimeout)
+	env.list("MONZO_CATEGORIES", &c.Monzo.Categories)
+	env.list("MONZO_EXCLUDED_CATEGORIES", &c.Monzo.ExcludedCategories)
+	env.list("MONZO_ACCOUNTS", &c.Monzo.Accounts)
+	env.secret("MONZO_WEBHOOK_SECRET", &c.Monzo.WebhookSecret)
+
+	if len(env.errs) > 0 {
+		return fmt.Errorf("invalid environment vars:\n  - %s", strings.Join(env.errs, "\n  - "))
+	}
+	return nil
+}
+
+// Validate checks that the config values are usable, returning an error describing every invalid value.
+func (c Config) Validate() error {
+	var errs []string
+	check := func(err error, field string) {
+		if err != nil {
+			errs = append(errs, field+": "+err.Error())
+		}
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port: must be between 1 and 65535, got %d", c.Port))
+	}
+	check(validateURL(c.WebAppHost), "web_app_host")
+	check(validateURL(c.ServiceHost), "service_host")
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("timezone: unknown timezone %q", c.Timezone))
+	}
+	check(validatePositive(c.ShutdownTimeout), "shutdown_timeout")
+	_, err := logging.ParseLevel(c.LogLevel)
+	check(err, "log_level")
+
+	check(validatePositive(c.Auth.SessionTTL), "auth.session_ttl")
+	for _, origin := range c.Auth.AllowedOrigins {
+		check(validateURL(origin), "auth.allowed_origins")
+	}
+
+	switch c.Storage.Backend {
+	case StorageBackendInflux:
+		check(validateURL(c.Influx.Host), "influx.host")
+	case StorageBackendDisk:
+		check(validateRequired(c.Storage.Path), "storage.path")
+	default:
+		errs = append(errs, fmt.Sprintf("storage.backend: must be %q or %q, got %q", StorageBackendInflux,
+			StorageBackendDisk, c.Storage.Backend))
+	}
+	check(validateRequired(c.Storage.OutboxDir), "storage.outbox_dir")
+	check(validateRequired(c.Storage.TokenDir), "storage.token_dir")
+
+	if c.Scheduler.Jitter < 0 {
+		errs = append(errs, "scheduler.jitter: must not be negative")
+	}
+
+	check(validateURL(c.Monzo.APIURL), "monzo.api_url")
+	check(validateURL(c.Monzo.AuthURL), "monzo.auth_url")
+	if c.Monzo.CollectTimeout < 0 {
+		errs = append(errs, "monzo.collect_timeout: must not be negative")
+	}
+	if (c.Monzo.ClientID == "") != (c.Monzo.ClientSecret == "") {
+		errs = append(errs, "monzo.client_id and monzo.client_secret: must be set together")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+// Secrets returns the config's secret values, which must never be logged.
+func (c Config) Secrets() []string {
+	secrets := []string{
+		c.Auth.Secret,
+		c.Auth.Password,
+		c.Auth.MetricsToken,
+		c.Storage.TokenSecret,
+		c.Influx.Token,
+		c.Monzo.ClientSecret,
+		c.Monzo.WebhookSecret,
+	}
+	return append(secrets, c.Auth.APITokens...)
+}
+
+// validateURL checks that the value is an absolute HTTP or HTTPS URL, e.g. https://example.com.
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an absolute http or https URL, got %q", value)
+	}
+	return nil
+}
+
+func validatePositive(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("must be a positive duration, got %s", d)
+	}
+	return nil
+}
+
+func validateRequired(value string) error {
+	if value == "" {
+		return errors.New("must be set")
+	}
+	return nil
+}
+
+// envOverrides overrides config values with environment variables, recording those which fail to parse.
+type envOverrides struct {
+	errs []string
+}
+
+// lookup gets an environment variable, reporting whether it is set.
+func (e *envOverrides) lookup(key string) (string, bool) {
 	val := os.Getenv(key)
 	if val == "" {
-		log.Printf("no %s environment var defined - defaulting to %s", key, defaultValue)
-		return defaultValue
+		return "", false
+	}
+
+	logging.Debugf("%s environment var found", key)
+	return val, true
+}
+
+// string overrides a string value.
+func (e *envOverrides) string(key string, v *string) {
+	if val, ok := e.lookup(key); ok {
+		*v = val
 	}
+}
+
+// int overrides an integer value.
+func (e *envOverrides) int(key string, v *int) {
+	val, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s: must be an integer, got %q", key, val))
+		return
+	}
+	*v = i
+}
+
+// duration overrides a duration value, e.g. 5m.
+func (e *envOverrides) duration(key string, v *time.Duration) {
+	val, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s: must be a duration such as 5m or 1h30m, got %q", key, val))
+		return
+	}
+	*v = d
+}
+
+// list overrides a list value with a comma separated list, e.g. a,b,c.
+func (e *envOverrides) list(key string, v *[]string) {
+	if val, ok := e.lookup(key); ok {
+		*v = splitList(val)
+	}
+}
+
+// secret overrides a secret string value, either from the environment var or from the file named by the environment
+// var with a _FILE suffix, which is how Docker and Kubernetes mount secrets.
+func (e *envOverrides) secret(key string, v *string) {
+	if val, ok := e.lookupSecret(key); ok {
+		*v = val
+	}
+}
 
-	log.Printf("%s environment var found", key)
-	return val
+// secretList overrides a secret list value with a comma separated list from the environment var, or a comma or newline
+// separated list from the file named by the environment var with a _FILE suffix.
+func (e *envOverrides) secretList(key string, v *[]string) {
+	if val, ok := e.lookupSecret(key); ok {
+		*v = splitList(strings.ReplaceAll(val, "\n", ","))
+	}
 }
 
-// getEnvVarInt gets an integer environment variable or defaults it if unset.
-func getEnvVarInt(key string, defaultValue int) int {
-	varStr := getEnvVar(key, strconv.Itoa(defaultValue))
-	varInt, _ := strconv.Atoi(varStr)
-	return varInt
+// lookupSecret gets a secret from an environment var or the file named by its _FILE variant, reporting whether either
+// is set. Trailing whitespace is trimmed from files, as editors and secret managers often append a newline.
+func (e *envOverrides) lookupSecret(key string) (string, bool) {
+	val, ok := e.lookup(key)
+	path, fileOK := e.lookup(key + "_FILE")
+	switch {
+	case ok && fileOK:
+		e.errs = append(e.errs, fmt.Sprintf("%s and %s_FILE: must not both be set", key, key))
+		return "", false
+	case !fileOK:
+		return val, ok
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s_FILE: failed to read secret file: %s", key, err))
+		return "", false
+	}
+	return strings.TrimRight(string(b), " \t\r\n"), true
+}
+
+// splitList splits a comma separated list, trimming whitespace and dropping empty items.
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -1,8 +1,45 @@
 #!/bin/bash
 
+# secret values are never printed, only whether they are set
+
+echo "CONFIG_PATH: ${CONFIG_PATH}"
 echo "PORT: ${PORT}"
+echo "TIMEZONE: ${TIMEZONE}"
+echo "SCHEMA_PATH: ${SCHEMA_PATH}"
+echo "USERS_PATH: ${USERS_PATH}"
+echo "AUTH_SECRET: ${AUTH_SECRET:+[REDACTED]}"
+echo "AUTH_SECRET_FILE: ${AUTH_SECRET_FILE}"
+echo "API_TOKENS: ${API_TOKENS:+[REDACTED]}"
+echo "API_TOKENS_FILE: ${API_TOKENS_FILE}"
+echo "WEB_APP_PASSWORD: ${WEB_APP_PASSWORD:+[REDACTED]}"
+echo "WEB_APP_PASSWORD_FILE: ${WEB_APP_PASSWORD_FILE}"
+echo "SESSION_TTL: ${SESSION_TTL}"
+echo "ALLOWED_ORIGINS: ${ALLOWED_ORIGINS}"
+echo "METRICS_TOKEN: ${METRICS_TOKEN:+[REDACTED]}"
+echo "METRICS_TOKEN_FILE: ${METRICS_TOKEN_FILE}"
+echo "SHUTDOWN_TIMEOUT: ${SHUTDOWN_TIMEOUT}"
+echo "LOG_LEVEL: ${LOG_LEVEL}"
+echo "STORAGE_BACKEND: ${STORAGE_BACKEND}"
+echo "STORAGE_PATH: ${STORAGE_PATH}"
+echo "OUTBOX_DIR: ${OUTBOX_DIR}"
+echo "TOKEN_DIR: ${TOKEN_DIR}"
+echo "TOKEN_SECRET: ${TOKEN_SECRET:+[REDACTED]}"
+echo "TOKEN_SECRET_FILE: ${TOKEN_SECRET_FILE}"
+echo "SCHEDULE_JITTER: ${SCHEDULE_JITTER}"
+echo "JOB_HISTORY_PATH: ${JOB_HISTORY_PATH}"
 echo "INFLUX_HOST: ${INFLUX_HOST}"
-echo "INFLUX_TOKEN: ${INFLUX_TOKEN}"
+echo "INFLUX_TOKEN: ${INFLUX_TOKEN:+[REDACTED]}"
+echo "INFLUX_TOKEN_FILE: ${INFLUX_TOKEN_FILE}"
 echo "INFLUX_ORG: ${INFLUX_ORG}"
 echo "MONZO_CLIENT_ID: ${MONZO_CLIENT_ID}"
-echo "MONZO_CLIENT_SECRET: ${MONZO_CLIENT_SECRET}"
+echo "MONZO_CLIENT_SECRET: ${MONZO_CLIENT_SECRET:+[REDACTED]}"
+echo "MONZO_CLIENT_SECRET_FILE: ${MONZO_CLIENT_SECRET_FILE}"
+echo "MONZO_API_URL: ${MONZO_API_URL}"
+echo "MONZO_AUTH_URL: ${MONZO_AUTH_URL}"
+echo "MONZO_SCHEDULE: ${MONZO_SCHEDULE}"
+echo "MONZO_COLLECT_TIMEOUT: ${MONZO_COLLECT_TIMEOUT}"
+echo "MONZO_CATEGORIES: ${MONZO_CATEGORIES}"
+echo "MONZO_EXCLUDED_CATEGORIES: ${MONZO_EXCLUDED_CATEGORIES}"
+echo "MONZO_ACCOUNTS: ${MONZO_ACCOUNTS}"
+echo "MONZO_WEBHOOK_SECRET: ${MONZO_WEBHOOK_SECRET:+[REDACTED]}"
+echo "MONZO_WEBHOOK_SECRET_FILE: ${MONZO_WEBHOOK_SECRET_FILE}"
@@ -1,8 +1,37 @@
 #!/bin/bash
 
+# secrets can instead be read from a file by setting the var with a _FILE suffix, e.g. INFLUX_TOKEN_FILE
+
+export CONFIG_PATH=""
 export PORT=""
+export TIMEZONE=""
+export SCHEMA_PATH=""
+export USERS_PATH=""
+export AUTH_SECRET=""
+export API_TOKENS=""
+export WEB_APP_PASSWORD=""
+export SESSION_TTL=""
+export ALLOWED_ORIGINS=""
+export METRICS_TOKEN=""
+export SHUTDOWN_TIMEOUT=""
+export LOG_LEVEL=""
+export STORAGE_BACKEND=""
+export STORAGE_PATH=""
+export OUTBOX_DIR=""
+export TOKEN_DIR=""
+export TOKEN_SECRET=""
+export SCHEDULE_JITTER=""
+export JOB_HISTORY_PATH=""
 export INFLUX_HOST=""
 export INFLUX_TOKEN=""
 export INFLUX_ORG=""
 export MONZO_CLIENT_ID=""
 export MONZO_CLIENT_SECRET=""
+export MONZO_API_URL=""
+export MONZO_AUTH_URL=""
+export MONZO_SCHEDULE=""
+export MONZO_COLLECT_TIMEOUT=""
+export MONZO_CATEGORIES=""
+export MONZO_EXCLUDED_CATEGORIES=""
+export MONZO_ACCOUNTS=""
+export MONZO_WEBHOOK_SECRET=""
@@ -0,0 +1,353 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+// Store is an embedded storage backend which requires no external services. All points are held in memory and each
+// write is appended to a file on disk, which is replayed when the Store is opened.
+type Store struct {
+	*db
+	// user limits the store to a single user's points - all points are accessible if empty
+	user string
+}
+
+// db holds the points and store file, which are shared by every user's view of the store.
+type db struct {
+	mu     sync.RWMutex
+	path   string
+	file   *os.File
+	points map[string]map[string]sources.Result
+}
+
+// entry is a single line in the store's append-only file, either writing a result or deleting a period. Deletes are
+// limited to a single user's points if User is set.
+type entry struct {
+	Measurement string          `json:"measurement"`
+	Result      *sources.Result `json:"result,omitempty"`
+	Delete      *sources.Period `json:"delete,omitempty"`
+	User        string          `json:"user,omitempty"`
+}
+
+// New opens the store file at the given path, creating it if it does not exist.
+func New(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %s", err)
+	}
+
+	s := &Store{
+		db: &db{
+			path:   path,
+			points: make(map[string]map[string]sources.Result),
+		},
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, fmt.Errorf("failed to replay store file: %s", err)
+	}
+
+	// rewrite the file with only the current points so that it doesn't grow unbounded with overwritten points
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("failed to compact store file: %s", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store file: %s", err)
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// replay applies every entry in the store file to the in-memory points.
+func (s *Store) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial trailing line indicates a write was interrupted, so it is discarded
+			if len(line) > 0 {
+				logging.Warnf("discarding incomplete entry at end of store file %s", s.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("failed to JSON decode store entry: %s", err)
+		}
+		switch {
+		case e.Result != nil:
+			s.apply(e.Measurement, *e.Result)
+		case e.Delete != nil:
+			s.remove(e.Measurement, *e.Delete, e.User)
+		}
+	}
+}
+
+// compact rewrites the store file to contain only the current set of points.
+func (s *Store) compact() error {
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for measurement, points := range s.points {
+		for _, point := range points {
+			point := point
+			if err := writeEntry(writer, entry{Measurement: measurement, Result: &point}); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+func writeEntry(w io.Writer, e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to JSON encode store entry: %s", err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// apply merges a result into the in-memory points. As with InfluxDB, a point is identified by its measurement, tag
+// set and timestamp, and writing to an existing point overwrites its fields.
+func (s *Store) apply(measurement string, result sources.Result) {
+	points, ok := s.points[measurement]
+	if !ok {
+		points = make(map[string]sources.Result)
+		s.points[measurement] = points
+	}
+
+	key := seriesKey(result)
+	existing, ok := points[key]
+	if !ok {
+		existing = copyResult(sources.Result{
+			Time: result.Time,
+			Tags: result.Tags,
+		})
+	}
+	for name, value := range result.Fields {
+		existing.Fields[name] = sources.NormaliseField(value)
+	}
+	points[key] = existing
+}
+
+// remove deletes the in-memory points for the measurement and user which fall within the period.
+func (s *Store) remove(measurement string, period sources.Period, user string) {
+	for key, point := range s.points[measurement] {
+		if belongsTo(point, user) && !point.Time.Before(period.Start) && point.Time.Before(period.End) {
+			delete(s.points[measurement], key)
+		}
+	}
+}
+
+// seriesKey uniquely identifies a point within a measurement from its timestamp and tag set.
+func seriesKey(result sources.Result) string {
+	tags := make([]string, 0, len(result.Tags))
+	for k, v := range result.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+
+	return strconv.FormatInt(result.Time.UnixNano(), 10) + "," + strings.Join(tags, ",")
+}
+
+// Write writes the provided data to the store file.
+func (s *Store) Write(measurement string, results ...sources.Result) error {
+	// no new data to store so skip writing
+	if len(results) == 0 {
+		return nil
+	}
+
+	results = storage.WithUser(s.user, results)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writer := bufio.NewWriter(s.file)
+	for _, result := range results {
+		result.Time = result.Time.UTC()
+		if err := writeEntry(writer, entry{Measurement: measurement, Result: &result}); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write to store file: %s", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync store file: %s", err)
+	}
+
+	for _, result := range results {
+		result.Time = result.Time.UTC()
+		s.apply(measurement, result)
+	}
+
+	return nil
+}
+
+// ReadDayLog reads the current day log's metrics.
+func (s *Store) ReadDayLog(day time.Time) (map[string]interface{}, error) {
+	// determine the day's boundaries in the day's location rather than UTC
+	year, month, date := day.Date()
+	startTime := time.Date(year, month, date, 0, 0, 0, 0, day.Location())
+	results, err := s.ReadRange("day_log", sources.NewPeriod(startTime, startTime.AddDate(0, 0, 1)))
+	if err != nil {
+		return nil, err
+	}
+
+	// later points take precedence over earlier ones
+	data := make(map[string]interface{})
+	for _, result := range results {
+		for name, value := range result.Fields {
+			data[name] = value
+		}
+	}
+
+	return data, nil
+}
+
+// ReadRange reads all results for the measurement which fall within the period, ordered by time. The period start is
+// inclusive and the period end is exclusive.
+func (s *Store) ReadRange(measurement string, period sources.Period) ([]sources.Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []sources.Result
+	for _, point := range s.points[measurement] {
+		if !belongsTo(point, s.user) || point.Time.Before(period.Start) || !point.Time.Before(period.End) {
+			continue
+		}
+		results = append(results, copyResult(point))
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+
+	return results, nil
+}
+
+// Delete deletes all results for the measurement which fall within the period.
+func (s *Store) Delete(measurement string, period sources.Period) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeEntry(s.file, entry{Measurement: measurement, Delete: &period, User: s.user}); err != nil {
+		return fmt.Errorf("failed to write to store file: %s", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync store file: %s", err)
+	}
+
+	s.remove(measurement, period, s.user)
+	return nil
+}
+
+// LastTimestampByMeasurement gets the timestamp associated with the most recent record for the given measurement.
+func (s *Store) LastTimestampByMeasurement(measurement string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var t time.Time
+	for _, point := range s.points[measurement] {
+		if belongsTo(point, s.user) && point.Time.After(t) {
+			t = point.Time
+		}
+	}
+
+	if t.IsZero() {
+		return time.Time{}, storage.ErrNoResults
+	}
+
+	return t, nil
+}
+
+// ForUser returns a view of the store scoped to the user with the provided ID.
+func (s *Store) ForUser(userID string) storage.Store {
+	return &Store{
+		db:   s.db,
+		user: userID,
+	}
+}
+
+// belongsTo determines whether the point belongs to the user. The default user, which has an empty ID, can access
+// every point.
+func belongsTo(point sources.Result, user string) bool {
+	return user == "" || point.Tags[storage.UserTag] == user
+}
+
+// Close closes the store file. Any further writes or deletes fail.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close store file: %s", err)
+	}
+	return nil
+}
+
+// copyResult copies a result so that callers cannot modify the stored point.
+func copyResult(result sources.Result) sources.Result {
+	c := sources.Result{
+		Time:   result.Time,
+		Fields: make(map[string]interface{}, len(result.Fields)),
+	}
+	if result.Tags != nil {
+		c.Tags = make(map[string]string, len(result.Tags))
+		for k, v := range result.Tags {
+			c.Tags[k] = v
+		}
+	}
+	for k, v := range result.Fields {
+		c.Fields[k] = v
+	}
+	return c
+}
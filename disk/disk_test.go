@@ -0,0 +1,203 @@
+package disk
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+var day = time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestStore opens a store in a new temp directory, returning the store file's path.
+func newTestStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	path := filepath.Join(dir, "life-metrics.db")
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	return s, path
+}
+
+func reopen(t *testing.T, s *Store, path string) *Store {
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	reopened, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	return reopened
+}
+
+func readAll(t *testing.T, s storage.Store, measurement string) []sources.Result {
+	results, err := s.ReadRange(measurement, sources.NewPeriod(day.AddDate(0, 0, -1), day.AddDate(0, 0, 7)))
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", measurement, err)
+	}
+	return results
+}
+
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open store file: %s", err)
+	}
+	defer file.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestStoreReplay(t *testing.T) {
+	s, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	tags := map[string]string{"category": "groceries"}
+	writes := []sources.Result{
+		{Time: day.Add(time.Hour), Tags: tags, Fields: map[string]interface{}{"price": 1.5, "notes": "milk"}},
+		// the same point, so the fields are merged and price is overwritten
+		{Time: day.Add(time.Hour), Tags: tags, Fields: map[string]interface{}{"price": 2.5, "settled": true}},
+		{Time: day.Add(time.Hour * 2), Tags: tags, Fields: map[string]interface{}{"count": 3}},
+		{Time: day.AddDate(0, 0, 1), Tags: tags, Fields: map[string]interface{}{"price": 4.0}},
+	}
+	for _, result := range writes {
+		if err := s.Write("monzo", result); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := s.Delete("monzo", sources.NewPeriod(day.AddDate(0, 0, 1), day.AddDate(0, 0, 2))); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+
+	want := []sources.Result{
+		{Time: day.Add(time.Hour), Tags: tags, Fields: map[string]interface{}{
+			"price": 2.5, "notes": "milk", "settled": true,
+		}},
+		{Time: day.Add(time.Hour * 2), Tags: tags, Fields: map[string]interface{}{"count": int64(3)}},
+	}
+	if got := readAll(t, s, "monzo"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("results before reopening = %+v, want %+v", got, want)
+	}
+
+	// the overwritten point and the deleted point are replayed, then compacted away
+	if lines := countLines(t, path); lines != 5 {
+		t.Errorf("store file has %d lines before reopening, want 5", lines)
+	}
+	s = reopen(t, s, path)
+	if got := readAll(t, s, "monzo"); !reflect.DeepEqual(got, want) {
+		t.Errorf("results after reopening = %+v, want %+v", got, want)
+	}
+	if lines := countLines(t, path); lines != 2 {
+		t.Errorf("store file has %d lines after compacting, want 2", lines)
+	}
+
+	last, err := s.LastTimestampByMeasurement("monzo")
+	if err != nil || !last.Equal(day.Add(time.Hour*2)) {
+		t.Errorf("last timestamp = %s, %v, want %s", last, err, day.Add(time.Hour*2))
+	}
+	if _, err := s.LastTimestampByMeasurement("day_log"); !errors.Is(err, storage.ErrNoResults) {
+		t.Errorf("last timestamp error for an empty measurement = %v, want %v", err, storage.ErrNoResults)
+	}
+}
+
+func TestStoreReplayDiscardsIncompleteEntry(t *testing.T) {
+	s, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	result := sources.Result{Time: day, Fields: map[string]interface{}{"general_mood": int64(7)}}
+	if err := s.Write("day_log", result); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	// simulate a write interrupted part way through a line
+	if _, err := s.file.WriteString(`{"measurement":"day_log","result":{"time":`); err != nil {
+		t.Fatalf("failed to write partial entry: %s", err)
+	}
+
+	s = reopen(t, s, path)
+	want := []sources.Result{{Time: day, Tags: nil, Fields: map[string]interface{}{"general_mood": int64(7)}}}
+	if got := readAll(t, s, "day_log"); !reflect.DeepEqual(got, want) {
+		t.Errorf("results after reopening = %+v, want %+v", got, want)
+	}
+}
+
+func TestStoreUserIsolation(t *testing.T) {
+	s, path := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	alice, bob := s.ForUser("alice"), s.ForUser("bob")
+	write := func(store storage.Store, at time.Time, mood int64) {
+		result := sources.Result{Time: at, Fields: map[string]interface{}{"general_mood": mood}}
+		if err := store.Write("day_log", result); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	// the same time and tags are separate points for each user
+	write(alice, day.Add(time.Hour), 7)
+	write(bob, day.Add(time.Hour), 3)
+	write(bob, day.AddDate(0, 0, 1), 4)
+
+	// points at the same time are in no particular order, so the moods are compared sorted
+	check := func(store storage.Store, name string, wantMoods ...int64) {
+		results := readAll(t, store, "day_log")
+		var moods []int64
+		for _, result := range results {
+			moods = append(moods, result.Fields["general_mood"].(int64))
+		}
+		sort.Slice(moods, func(i, j int) bool {
+			return moods[i] < moods[j]
+		})
+		if !reflect.DeepEqual(moods, wantMoods) {
+			t.Errorf("%s's moods = %v, want %v", name, moods, wantMoods)
+		}
+	}
+	check(alice, "alice", 7)
+	check(bob, "bob", 3, 4)
+	check(s.ForUser("carol"), "carol")
+	// the default user can access every user's points
+	check(s, "default", 3, 4, 7)
+
+	dayLog, err := alice.ReadDayLog(day)
+	if err != nil || dayLog["general_mood"] != int64(7) {
+		t.Errorf("alice's day log = %v, %v, want a general_mood of 7", dayLog, err)
+	}
+	last, err := alice.LastTimestampByMeasurement("day_log")
+	if err != nil || !last.Equal(day.Add(time.Hour)) {
+		t.Errorf("alice's last timestamp = %s, %v, want %s", last, err, day.Add(time.Hour))
+	}
+	if _, err := s.ForUser("carol").LastTimestampByMeasurement("day_log"); !errors.Is(err, storage.ErrNoResults) {
+		t.Errorf("carol's last timestamp error = %v, want %v", err, storage.ErrNoResults)
+	}
+
+	// deleting alice's day only deletes her points, including once the deletion is replayed
+	if err := alice.Delete("day_log", sources.NewPeriod(day, day.AddDate(0, 0, 1))); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	check(alice, "alice")
+	check(bob, "bob", 3, 4)
+
+	s = reopen(t, s, path)
+	check(s.ForUser("alice"), "alice")
+	check(s.ForUser("bob"), "bob", 3, 4)
+	for _, result := range readAll(t, s.ForUser("bob"), "day_log") {
+		if result.Tags[storage.UserTag] != "bob" {
+			t.Errorf("bob's result has user tag %q", result.Tags[storage.UserTag])
+		}
+	}
+}
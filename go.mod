@@ -2,4 +2,7 @@ module github.com/jemgunay/life-metrics
 
 go 1.14
 
-require github.com/influxdata/influxdb-client-go/v2 v2.3.0
+require (
+	github.com/influxdata/influxdb-client-go/v2 v2.3.0
+	gopkg.in/yaml.v2 v2.3.0
+)
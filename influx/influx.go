@@ -4,31 +4,43 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"sort"
 	"time"
 
 	"github.com/influxdata/influxdb-client-go/v2"
 	influxdbapi "github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 
 	"github.com/jemgunay/life-metrics/config"
+	"github.com/jemgunay/life-metrics/logging"
 	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
 )
 
 const bucket = "life-metrics"
 
-// Requester is used to write to and query influx.
+// Requester is used to write to, query and delete from influx.
 type Requester struct {
-	writeClient influxdbapi.WriteAPIBlocking
-	readClient  influxdbapi.QueryAPI
+	client       influxdb2.Client
+	org          string
+	writeClient  influxdbapi.WriteAPIBlocking
+	readClient   influxdbapi.QueryAPI
+	deleteClient influxdbapi.DeleteAPI
+	// user limits the requester to a single user's points - all points are accessible if empty
+	user string
 }
 
 // New returns an initialised influx requester.
 func New(conf config.Influx) Requester {
 	client := influxdb2.NewClient(conf.Host, conf.Token)
 	return Requester{
-		writeClient: client.WriteAPIBlocking(conf.Org, bucket),
-		readClient:  client.QueryAPI(conf.Org),
+		client:       client,
+		org:          conf.Org,
+		writeClient:  client.WriteAPIBlocking(conf.Org, bucket),
+		readClient:   client.QueryAPI(conf.Org),
+		deleteClient: client.DeleteAPI(),
 	}
 }
 
@@ -39,7 +51,8 @@ func (r Requester) Write(measurement string, results ...sources.Result) error {
 		return nil
 	}
 
-	log.Printf("writing to influx: %+v", results)
+	results = storage.WithUser(r.user, results)
+	logging.Debugf("writing %d %s points to influx", len(results), measurement)
 
 	points := make([]*write.Point, 0, len(results))
 	for _, result := range results {
@@ -53,6 +66,13 @@ func (r Requester) Write(measurement string, results ...sources.Result) error {
 	}
 
 	if err := r.writeClient.WritePoint(context.Background(), points...); err != nil {
+		// the request was malformed or conflicts with the existing data, e.g. a field's type differs
+		var httpErr *influxhttp.Error
+		if errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusBadRequest ||
+			httpErr.StatusCode == http.StatusRequestEntityTooLarge ||
+			httpErr.StatusCode == http.StatusUnprocessableEntity) {
+			return fmt.Errorf("%w: writing points to influx failed: %s", storage.ErrRejected, err)
+		}
 		return fmt.Errorf("writing points to influx failed: %s", err)
 	}
 
@@ -61,13 +81,15 @@ func (r Requester) Write(measurement string, results ...sources.Result) error {
 
 // ReadDayLog queries influx for the current day log's metrics.
 func (r Requester) ReadDayLog(day time.Time) (map[string]interface{}, error) {
-	startTime := day.Truncate(time.Hour * 24)
-	endTime := startTime.Add(time.Hour * 24).Add(-time.Second)
+	// determine the day's boundaries in the day's location rather than UTC
+	year, month, date := day.Date()
+	startTime := time.Date(year, month, date, 0, 0, 0, 0, day.Location())
+	endTime := startTime.AddDate(0, 0, 1)
 
 	query := `from(bucket: "` + bucket + `")
-  	|> range(start: ` + startTime.Format(time.RFC3339) + `, stop: ` + endTime.Format(time.RFC3339) + `)
+  	|> range(start: ` + startTime.UTC().Format(time.RFC3339) + `, stop: ` + endTime.UTC().Format(time.RFC3339) + `)
   	|> filter(fn:(r) =>
-    	r._measurement == "day_log"
+    	r._measurement == "day_log"` + r.userFilter() + `
   	)
   	|> last()`
 
@@ -84,15 +106,77 @@ func (r Requester) ReadDayLog(day time.Time) (map[string]interface{}, error) {
 	return data, nil
 }
 
-// ErrNoResults indicates that there are no results for the executed influx query.
-var ErrNoResults = errors.New("no influx results for query")
+// ReadRange queries influx for all results for the measurement which fall within the period, ordered by time.
+func (r Requester) ReadRange(measurement string, period sources.Period) ([]sources.Result, error) {
+	query := `from(bucket: "` + bucket + `")
+  	|> range(start: ` + period.Start.UTC().Format(time.RFC3339) + `, stop: ` + period.End.UTC().Format(time.RFC3339) + `)
+  	|> filter(fn:(r) =>
+    	r._measurement == "` + measurement + `"` + r.userFilter() + `
+  	)`
+
+	result, err := r.readClient.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query influx: %s", err)
+	}
+
+	// influx returns a record per field, so group fields into results by their timestamp and tag set
+	var results []sources.Result
+	resultIndexes := make(map[string]int)
+	for result.Next() {
+		record := result.Record()
+
+		tags := make(map[string]string)
+		for k, v := range record.Values() {
+			if _, ok := reservedColumns[k]; ok {
+				continue
+			}
+			if s, ok := v.(string); ok {
+				tags[k] = s
+			}
+		}
+
+		key := record.Time().String() + fmt.Sprint(tags)
+		i, ok := resultIndexes[key]
+		if !ok {
+			i = len(results)
+			resultIndexes[key] = i
+			results = append(results, sources.Result{
+				Time:   record.Time(),
+				Tags:   tags,
+				Fields: make(map[string]interface{}),
+			})
+		}
+		results[i].Fields[record.Field()] = record.Value()
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("failed to parse influx query result: %s", result.Err())
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+
+	return results, nil
+}
+
+// reservedColumns are the influx query result columns which do not correspond to tags.
+var reservedColumns = map[string]struct{}{
+	"result":       {},
+	"table":        {},
+	"_start":       {},
+	"_stop":        {},
+	"_time":        {},
+	"_value":       {},
+	"_field":       {},
+	"_measurement": {},
+}
 
 // LastTimestampByMeasurement gets the timestamp associated with the first record for the given measurement.
 func (r Requester) LastTimestampByMeasurement(measurement string) (time.Time, error) {
 	query := `from(bucket: "` + bucket + `")
   	|> range(start: 0, stop: now())
   	|> filter(fn:(r) =>
-    	r._measurement == "` + measurement + `"
+    	r._measurement == "` + measurement + `"` + r.userFilter() + `
   	)
   	|> last()`
 
@@ -110,8 +194,45 @@ func (r Requester) LastTimestampByMeasurement(measurement string) (time.Time, er
 	}
 
 	if t.IsZero() {
-		return time.Time{}, ErrNoResults
+		return time.Time{}, storage.ErrNoResults
 	}
 
 	return t, nil
 }
+
+// Delete deletes all points for the given measurement which fall within the period.
+func (r Requester) Delete(measurement string, period sources.Period) error {
+	// the influx delete API's stop time is inclusive, whereas period ends are exclusive
+	stop := period.End.Add(-time.Nanosecond)
+	predicate := `_measurement="` + measurement + `"`
+	if r.user != "" {
+		predicate += ` AND ` + storage.UserTag + `="` + r.user + `"`
+	}
+
+	err := r.deleteClient.DeleteWithName(context.Background(), r.org, bucket, period.Start, stop, predicate)
+	if err != nil {
+		return fmt.Errorf("failed to delete from influx: %s", err)
+	}
+
+	return nil
+}
+
+// ForUser returns a requester scoped to the user with the provided ID.
+func (r Requester) ForUser(userID string) storage.Store {
+	r.user = userID
+	return r
+}
+
+// userFilter is the flux filter condition which limits a query to the requester's user, if set.
+func (r Requester) userFilter() string {
+	if r.user == "" {
+		return ""
+	}
+	return ` and r.` + storage.UserTag + ` == "` + r.user + `"`
+}
+
+// Close closes the influx client, flushing any pending writes.
+func (r Requester) Close() error {
+	r.client.Close()
+	return nil
+}
@@ -1,120 +1,344 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jemgunay/life-metrics/api"
+	"github.com/jemgunay/life-metrics/auth"
 	"github.com/jemgunay/life-metrics/config"
+	"github.com/jemgunay/life-metrics/disk"
 	"github.com/jemgunay/life-metrics/influx"
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/metrics"
+	"github.com/jemgunay/life-metrics/outbox"
+	"github.com/jemgunay/life-metrics/poller"
+	"github.com/jemgunay/life-metrics/schema"
 	"github.com/jemgunay/life-metrics/sources"
 	"github.com/jemgunay/life-metrics/sources/monzo"
+	"github.com/jemgunay/life-metrics/sources/monzo/fake"
+	"github.com/jemgunay/life-metrics/storage"
+	"github.com/jemgunay/life-metrics/tokens"
+	"github.com/jemgunay/life-metrics/users"
 )
 
 func main() {
-	conf := config.New()
+	configPath := flag.String("config", os.Getenv("CONFIG_PATH"),
+		"YAML or JSON config file, overridden by environment vars (defaults to CONFIG_PATH)")
+	fakeMonzo := flag.Bool("fake-monzo", false, "collect Monzo data from a local fake Monzo server rather than Monzo")
+	flag.Parse()
 
-	// influx storage
-	influxRequester := influx.New(conf.Influx)
+	// commands run then exit, e.g. life-metrics config validate --config file.yaml
+	if args := flag.Args(); len(args) > 0 {
+		if len(args) < 2 {
+			logging.Fatalf("unknown command %q - the commands are \"config validate\" and \"migrate daylogs\"",
+				strings.Join(args, " "))
+		}
+		flag.CommandLine.Parse(args[2:])
+		if flag.NArg() > 0 {
+			logging.Fatalf("unexpected arguments %q", strings.Join(flag.Args(), " "))
+		}
 
-	// configure data sources
-	monzoSource := monzo.New(conf, influxRequester)
-	p := poller{
-		sources: []sources.Source{
-			monzoSource,
-		},
-		scrapeChan: make(chan collectRequest, 1),
+		switch command := args[0] + " " + args[1]; command {
+		case "config validate":
+			if err := validateConfig(*configPath); err != nil {
+				logging.Fatalf("%s", err)
+			}
+			logging.Infof("config is valid")
+		case "migrate daylogs":
+			if err := migrateDayLogs(*configPath); err != nil {
+				logging.Fatalf("failed to migrate day logs: %s", err)
+			}
+		default:
+			logging.Fatalf("unknown command %q - the commands are \"config validate\" and \"migrate daylogs\"",
+				command)
+		}
+		return
 	}
 
-	// start collection poller
-	go p.start(influxRequester)
-
-	// define handlers
-	apiHandler := api.New(influxRequester).Handler
-	http.HandleFunc("/api/data/daylog", enableCORS(apiHandler))
-	http.HandleFunc("/api/data/collect", enableCORS(p.collectHandler))
-	http.HandleFunc("/api/data/sources", enableCORS(p.sourcesHandler))
-	http.HandleFunc("/api/auth/monzo", monzoSource.AuthenticateHandler)
-	http.HandleFunc("/health", healthHandler)
-
-	log.Printf("HTTP server starting on port %d", conf.Port)
-	err := http.ListenAndServe(":"+strconv.Itoa(conf.Port), nil)
-	log.Printf("HTTP server shut down: %s", err)
-}
+	conf, err := config.New(*configPath)
+	if err != nil {
+		logging.Fatalf("failed to load config: %s", err)
+	}
+	// the config has been validated, so the level is known to be valid
+	level, _ := logging.ParseLevel(conf.LogLevel)
+	logging.SetLevel(level)
+	logging.AddSecrets(conf.Secrets()...)
 
-// collectRequest specifies collection details.
-type collectRequest struct {
-	reset bool
-}
+	// storage backend
+	store, err := newStore(conf)
+	if err != nil {
+		logging.Fatalf("failed to initialise %s storage backend: %s", conf.Storage.Backend, err)
+	}
+	store = storage.Instrument(store, conf.Storage.Backend)
 
-// poller serialises access to source operations.
-type poller struct {
-	sources    []sources.Source
-	scrapeChan chan collectRequest
-}
+	// spool source writes which fail so that they can be retried
+	sourceOutbox, err := outbox.New(store, conf.Storage.OutboxDir)
+	if err != nil {
+		logging.Fatalf("failed to initialise outbox: %s", err)
+	}
 
-// start polls for scrape requests and performs collections for each source.
-func (p poller) start(influxRequester influx.Requester) {
-	for req := range p.scrapeChan {
-		endTime := time.Now().UTC()
-
-		// perform collection for each source
-		for _, source := range p.sources {
-			var startTime time.Time
-			if req.reset {
-				startTime = time.Date(2000, 0, 0, 0, 0, 0, 0, time.UTC)
-
-			} else {
-				var err error
-				startTime, err = influxRequester.LastTimestampByMeasurement(source.Name())
-				if err != nil {
-					log.Printf("failed to get last timestamp for source %s: %s", source.Name(), err)
-					continue
-				}
-				// add a second to ensure we don't recollect the last record
-				startTime = startTime.Add(time.Second)
+	// timezone to bucket day logs into days in and to evaluate schedules in
+	location, err := time.LoadLocation(conf.Timezone)
+	if err != nil {
+		logging.Fatalf("failed to load timezone: %s", err)
+	}
+
+	// users whose data is isolated from each other's
+	userList, err := users.Load(conf.Auth.UsersPath, conf.Auth, location)
+	if err != nil {
+		logging.Fatalf("failed to load users: %s", err)
+	}
+	for _, user := range userList {
+		logging.AddSecrets(user.Secrets()...)
+	}
+	if conf.Storage.TokenSecret == "" {
+		logging.Warnf("no token secret set - source OAuth tokens will not be persisted across restarts")
+	}
+
+	if *fakeMonzo {
+		fakeURL, err := startFakeMonzo()
+		if err != nil {
+			logging.Fatalf("failed to start fake Monzo server: %s", err)
+		}
+		logging.Infof("fake Monzo server started at %s", fakeURL)
+
+		conf.Monzo.APIURL = fakeURL
+		conf.Monzo.AuthURL = fakeURL
+		conf.Monzo.ClientID = fake.ClientID
+		conf.Monzo.ClientSecret = fake.ClientSecret
+		for i := range userList {
+			userList[i].Monzo = users.Monzo{}
+		}
+	}
+
+	// sign values handed to clients, e.g. sessions and OAuth state values
+	if conf.Auth.Secret == "" {
+		logging.Warnf("no auth secret set - a random secret will be used, so sessions and pending OAuth sequences are " +
+			"invalidated by a restart")
+	}
+	signer, err := auth.NewSigner(conf.Auth.Secret)
+	if err != nil {
+		logging.Fatalf("failed to initialise signer: %s", err)
+	}
+	authenticator := auth.NewAuthenticator(conf, signer, userList)
+	if !authenticator.Enabled() {
+		logging.Warnf("no API tokens or web app password set - API authentication is disabled")
+	} else if conf.Auth.MetricsToken == "" {
+		logging.Warnf("no metrics token set - the metrics endpoint is disabled")
+	}
+
+	// configure data sources - the poller creates an instance of each source for every user
+	p, err := poller.New(store, sourceOutbox, location, conf.Scheduler.Jitter, conf.Scheduler.JobHistoryPath,
+		userList)
+	if err != nil {
+		logging.Fatalf("failed to initialise poller: %s", err)
+	}
+	monzoSources := make(map[string]*monzo.Monzo, len(userList))
+	err = p.Add(func(user users.User, exporter sources.Exporter) (sources.Source, error) {
+		// persist source OAuth tokens so that sources remain authenticated across restarts, but don't persist fake
+		// tokens in place of real ones
+		var tokenStore tokens.Store = tokens.Nop{}
+		if !*fakeMonzo {
+			var err error
+			if tokenStore, err = newTokenStore(conf, user.ID); err != nil {
+				return nil, fmt.Errorf("failed to initialise token store: %s", err)
 			}
+		}
+
+		monzoSources[user.ID] = monzo.New(conf, user, exporter, store.ForUser(user.ID), tokenStore, signer)
+		return monzoSources[user.ID], nil
+	}, conf.Monzo.Schedule, conf.Monzo.CollectTimeout)
+	if err != nil {
+		logging.Fatalf("failed to add Monzo source: %s", err)
+	}
+
+	// start collection poller
+	go p.Start(context.Background())
+
+	// stop on SIGTERM, e.g. when Cloud Run or App Engine restarts the service
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// day log schema
+	daySchema, err := schema.Load(conf.SchemaPath)
+	if err != nil {
+		logging.Fatalf("failed to load day log schema: %s", err)
+	}
 
-			source.Collect(sources.NewPeriod(startTime, endTime))
+	// define handlers - data endpoints require authentication, and the requests to every endpoint are recorded by the
+	// metrics endpoint
+	cors := enableCORS(authenticator)
+	authenticated := func(f http.HandlerFunc) http.HandlerFunc {
+		return cors(authenticator.Middleware(f))
+	}
+	handle := func(route string, f http.HandlerFunc) {
+		http.HandleFunc(route, metrics.InstrumentHandler(route, f))
+	}
+	apiHandler := api.New(store, daySchema, userList)
+	handle("/api/data/daylog", authenticated(apiHandler.Handler))
+	handle("/api/data/daylog/history", authenticated(apiHandler.HistoryHandler))
+	handle("/api/data/daylogs", authenticated(apiHandler.DayLogsHandler))
+	handle("/api/schema", cors(apiHandler.SchemaHandler))
+	handle("/api/data/collect", authenticated(p.CollectHandler))
+	handle("/api/data/collect/", authenticated(p.JobHandler))
+	handle("/api/data/sources", authenticated(p.SourcesHandler))
+	handle("/api/auth/session", cors(authenticator.SessionHandler))
+	handle("/api/auth/monzo", authenticator.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		userID := auth.UserID(r.Context())
+		monzoSource, ok := monzoSources[userID]
+		if !ok {
+			logging.Warnf("no Monzo source for user %s", userID)
+			http.Error(w, "no Monzo source is configured for the user", http.StatusNotFound)
+			return
+		}
+		monzoSource.AuthenticateHandler(w, r)
+	}))
+	// webhook requests are verified by the Monzo source, and identify the user they are for in the user query
+	handle("/api/webhook/monzo", func(w http.ResponseWriter, r *http.Request) {
+		monzoSource, ok := monzoSources[r.URL.Query().Get("user")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
+		monzoSource.WebhookHandler(w, r)
+	})
+	handle("/health", healthHandler)
+	handle("/metrics", authenticator.MetricsMiddleware(metrics.Handler))
+
+	server := &http.Server{
+		Addr: ":" + strconv.Itoa(conf.Port),
 	}
+	go func() {
+		logging.Infof("HTTP server starting on port %d", conf.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatalf("HTTP server failed: %s", err)
+		}
+	}()
+
+	sig := <-stopChan
+	logging.Infof("received %s signal, shutting down within %s", sig, conf.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting requests and wait for in progress requests to complete
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Errorf("failed to gracefully shut down HTTP server: %s", err)
+	}
+	// wait for the in progress collection to complete, or cancel it if it exceeds the shutdown deadline
+	if err := p.Shutdown(ctx); err != nil {
+		logging.Warnf("cancelled in progress collection: %s", err)
+	}
+	// stop retrying in the background without waiting out the backoff, then attempt to write any spooled writes -
+	// those which fail are retried after the next start
+	sourceOutbox.Close()
+	if err := sourceOutbox.Flush(ctx); err != nil {
+		logging.Errorf("failed to flush outbox: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		logging.Errorf("failed to close %s storage backend: %s", conf.Storage.Backend, err)
+	}
+
+	logging.Infof("shut down complete")
 }
 
-func (p poller) collectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+// validateConfig loads and validates the config, along with the files and schedules that it references.
+func validateConfig(path string) error {
+	conf, err := config.New(path)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(conf.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load timezone: %s", err)
 	}
+	if _, err := schema.Load(conf.SchemaPath); err != nil {
+		return fmt.Errorf("failed to load day log schema: %s", err)
+	}
+	if _, err := users.Load(conf.Auth.UsersPath, conf.Auth, location); err != nil {
+		return fmt.Errorf("failed to load users: %s", err)
+	}
+	if err := poller.ValidateSchedule(conf.Monzo.Schedule, location); err != nil {
+		return fmt.Errorf("invalid Monzo schedule: %s", err)
+	}
+	return nil
+}
+
+// migrateDayLogs moves each user's day logs stored at UTC midnight, as they were before day logs were bucketed into
+// days in a timezone, to the start of the same date in the user's timezone.
+func migrateDayLogs(path string) error {
+	conf, err := config.New(path)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(conf.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load timezone: %s", err)
+	}
+	userList, err := users.Load(conf.Auth.UsersPath, conf.Auth, location)
+	if err != nil {
+		return fmt.Errorf("failed to load users: %s", err)
+	}
+	store, err := newStore(conf)
+	if err != nil {
+		return fmt.Errorf("failed to initialise %s storage backend: %s", conf.Storage.Backend, err)
+	}
+	defer store.Close()
 
-	req := collectRequest{
-		reset: r.URL.Query().Get("reset") == "true",
+	apiHandler := api.New(store, schema.Schema{}, userList)
+	for _, user := range userList {
+		moved, err := apiHandler.MigrateUTCDayLogs(user.ID)
+		if err != nil {
+			return fmt.Errorf("user %q: %s", user.ID, err)
+		}
+		logging.Infof("migrated %d day log points for user %q to %s", moved, user.ID, user.Location)
 	}
+	return nil
+}
 
-	select {
-	case p.scrapeChan <- req:
-		w.WriteHeader(http.StatusAccepted)
+// newStore initialises the storage backend selected in the config.
+func newStore(conf config.Config) (storage.Store, error) {
+	switch conf.Storage.Backend {
+	case config.StorageBackendInflux:
+		return influx.New(conf.Influx), nil
+	case config.StorageBackendDisk:
+		return disk.New(conf.Storage.Path)
 	default:
-		w.WriteHeader(http.StatusTooManyRequests)
+		return nil, fmt.Errorf("unsupported storage backend %q", conf.Storage.Backend)
 	}
 }
 
-func (p poller) sourcesHandler(w http.ResponseWriter, r *http.Request) {
-	resp := make(map[string]sources.StateSet, len(p.sources))
-	for _, source := range p.sources {
-		resp[source.Name()] = source.State()
+// newTokenStore initialises the user's source OAuth token store. Tokens are only persisted if an encryption secret is
+// set. Each user's tokens are persisted to their own subdirectory, other than the default user's.
+func newTokenStore(conf config.Config, userID string) (tokens.Store, error) {
+	if conf.Storage.TokenSecret == "" {
+		return tokens.Nop{}, nil
 	}
+	return tokens.NewFile(filepath.Join(conf.Storage.TokenDir, userID), conf.Storage.TokenSecret)
+}
 
-	b, err := json.Marshal(resp)
+// startFakeMonzo serves a fake Monzo server on a random local port, returning its URL.
+func startFakeMonzo() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Printf("failed to JSON marshal source state: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", err
 	}
 
-	w.Write(b)
+	go func() {
+		err := http.Serve(listener, fake.New())
+		logging.Infof("fake Monzo server shut down: %s", err)
+	}()
+	return "http://" + listener.Addr().String(), nil
 }
 
 var startTimestamp = time.Now().UTC().Format(time.RFC3339)
@@ -124,10 +348,24 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// enableCORS enables CORS for handlers that it wraps.
-func enableCORS(f http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		f(w, r)
+// enableCORS returns middleware which enables CORS for requests from the authenticator's allowed origins to the
+// handlers that it wraps. Credentials are allowed so that the web app's session cookie is sent.
+func enableCORS(authenticator *auth.Authenticator) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); authenticator.AllowedOrigin(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			// respond to preflight requests, which are made by browsers before non-simple requests such as DELETE
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			f(w, r)
+		}
 	}
 }
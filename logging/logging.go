@@ -0,0 +1,93 @@
+// Package logging writes leveled log messages via the standard logger, redacting secrets and sensitive values from
+// everything written to it.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message. Messages below the configured level are discarded.
+type Level int32
+
+// Levels in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, i.e. debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("must be debug, info, warn or error, got %q", name)
+}
+
+var currentLevel = int32(LevelInfo)
+
+func init() {
+	log.SetOutput(redactingWriter{out: os.Stderr})
+}
+
+// SetLevel sets the minimum level of the messages which are logged.
+func SetLevel(level Level) {
+	atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+// Enabled determines whether messages of the level are logged.
+func Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&currentLevel)
+}
+
+// Debugf logs diagnostic detail which is only useful when investigating an issue.
+func Debugf(format string, v ...interface{}) {
+	output(LevelDebug, format, v...)
+}
+
+// Infof logs a routine event.
+func Infof(format string, v ...interface{}) {
+	output(LevelInfo, format, v...)
+}
+
+// Warnf logs an unexpected event which the service has recovered from.
+func Warnf(format string, v ...interface{}) {
+	output(LevelWarn, format, v...)
+}
+
+// Errorf logs a failure.
+func Errorf(format string, v ...interface{}) {
+	output(LevelError, format, v...)
+}
+
+// Fatalf logs a failure regardless of the level, then exits.
+func Fatalf(format string, v ...interface{}) {
+	log.Output(2, "FATAL "+fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func output(level Level, format string, v ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	// skip output and the exported logging func so that the caller's position is reported
+	log.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets and sensitive values in log messages.
+const Redacted = "[REDACTED]"
+
+// minSecretLength is the length below which secrets aren't redacted, as they would match unrelated text.
+const minSecretLength = 4
+
+var (
+	secretsMu sync.RWMutex
+	// secrets maps a name to the secret value registered under it
+	secrets  = make(map[string]string)
+	replacer = strings.NewReplacer()
+)
+
+// sensitivePatterns match secrets which haven't been registered, such as bearer tokens and credentials passed in query
+// strings or JSON bodies. The first group is retained. OAuth codes and states are only matched as query parameters, as
+// code= and state= are common in ordinary log messages.
+var sensitivePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`(?i)\b((?:access_|refresh_|api_)?token=|secret=|password=)[^&\s"'(),]+`),
+	regexp.MustCompile(`(?i)([?&](?:code|state)=)[^&\s"'(),]+`),
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|token|client_secret|password)"\s*:\s*")[^"]*`),
+}
+
+// AddSecrets registers values which are redacted from log messages, such as config secrets.
+func AddSecrets(values ...string) {
+	for _, value := range values {
+		SetSecret(value, value)
+	}
+}
+
+// SetSecret registers the value which is redacted from log messages under a name, replacing the value previously
+// registered under the name. This is used for secrets which rotate, such as OAuth access tokens.
+func SetSecret(name, value string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if len(value) < minSecretLength {
+		delete(secrets, name)
+	} else {
+		secrets[name] = value
+	}
+
+	// replace the longest secrets first, so that a secret containing another is redacted entirely
+	values := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		values = append(values, secret)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	pairs := make([]string, 0, len(values)*2)
+	for _, value := range values {
+		pairs = append(pairs, value, Redacted)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces the registered secrets and any values which look like credentials in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	s = replacer.Replace(s)
+	secretsMu.RUnlock()
+
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+Redacted)
+	}
+	return s
+}
+
+// redactingWriter redacts everything written to the standard logger.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,45 @@
+package logging
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "query credentials",
+			in:   "GET /api/auth/monzo?code=abc123&state=xyz789 failed",
+			want: "GET /api/auth/monzo?code=[REDACTED]&state=[REDACTED] failed",
+		},
+		{
+			name: "query token",
+			in:   "POST /oauth2/token?client_id=id&access_token=abc123",
+			want: "POST /oauth2/token?client_id=id&access_token=[REDACTED]",
+		},
+		{
+			name: "bearer token",
+			in:   "Authorization: Bearer abc123",
+			want: "Authorization: Bearer [REDACTED]",
+		},
+		{
+			name: "status code",
+			in:   "request failed with status code=500",
+			want: "request failed with status code=500",
+		},
+		{
+			name: "job state",
+			in:   "collection job 3 state=running sources=monzo",
+			want: "collection job 3 state=running sources=monzo",
+		},
+		{
+			name: "error code",
+			in:   "Monzo responded with error_code=forbidden.insufficient_permissions",
+			want: "Monzo responded with error_code=forbidden.insufficient_permissions",
+		},
+	}
+	for _, test := range tests {
+		if got := Redact(test.in); got != test.want {
+			t.Errorf("%s: Redact(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
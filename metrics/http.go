@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounter("life_metrics_http_requests_total",
+		"HTTP requests served, by route, method and status code.", "route", "method", "code")
+	httpRequestDuration = NewHistogram("life_metrics_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route.", DefBuckets, "route")
+)
+
+// InstrumentHandler records the count and latency of the requests served by the handler under the route, which should
+// be the pattern the handler is registered with rather than the request path so that the number of series is bounded.
+func InstrumentHandler(route string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		f(sw, r)
+
+		httpRequestDuration.ObserveDuration(start, route)
+		httpRequests.Inc(route, method(r.Method), strconv.Itoa(sw.status))
+	}
+}
+
+// method returns the request method, or "other" for nonstandard methods so that clients can't create unbounded series.
+func method(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodOptions:
+		return m
+	}
+	return "other"
+}
+
+// statusWriter records the status code written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
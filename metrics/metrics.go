@@ -0,0 +1,275 @@
+// Package metrics records service metrics and exposes them to Prometheus in its text exposition format. Metrics are
+// declared by the packages which record them and are registered with the package's registry on creation.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+)
+
+// DefBuckets are histogram buckets suited to request latencies, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	registryMu sync.Mutex
+	registry   []*family
+)
+
+// family is a named metric and its time series, one for each combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	// buckets are the upper bounds of a histogram's buckets
+	buckets []float64
+	// transform converts a series' value when it is exposed
+	transform func(float64) float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a single time series. Counters and gauges only use value, whereas histograms also count observations per
+// bucket, with value holding the sum of the observations.
+type series struct {
+	labelValues  []string
+	value        float64
+	count        uint64
+	bucketCounts []uint64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+	registryMu.Lock()
+	registry = append(registry, f)
+	registryMu.Unlock()
+	return f
+}
+
+// update applies fn to the series for the label values, creating the series if it doesn't exist.
+func (f *family) update(labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labelValues:  append([]string(nil), labelValues...),
+			bucketCounts: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Counter is a metric whose value only increases, such as the number of requests served.
+type Counter struct {
+	f *family
+}
+
+// NewCounter creates and registers a counter with the provided label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: newFamily(name, help, "counter", labels)}
+}
+
+// Inc increments the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter for the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.f.update(labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Gauge is a metric whose value can go up and down, such as a timestamp.
+type Gauge struct {
+	f *family
+}
+
+// NewGauge creates and registers a gauge with the provided label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: newFamily(name, help, "gauge", labels)}
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) {
+		s.value = v
+	})
+}
+
+// SetMax sets the gauge for the label values if v is greater than its current value.
+func (g *Gauge) SetMax(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) {
+		s.value = math.Max(s.value, v)
+	})
+}
+
+// NewAgeGauge creates and registers a gauge which is set to times, but which exposes the number of seconds elapsed
+// since the time it is set to, such as the age of the newest record.
+func NewAgeGauge(name, help string, labels ...string) *Gauge {
+	f := newFamily(name, help, "gauge", labels)
+	f.transform = func(v float64) float64 {
+		return float64(time.Now().UnixNano())/1e9 - v
+	}
+	return &Gauge{f: f}
+}
+
+// SetTime sets the gauge to the time as a Unix timestamp in seconds.
+func (g *Gauge) SetTime(t time.Time, labelValues ...string) {
+	g.Set(float64(t.UnixNano())/1e9, labelValues...)
+}
+
+// SetMaxTime sets the gauge to the time as a Unix timestamp in seconds if it is later than the gauge's current time.
+func (g *Gauge) SetMaxTime(t time.Time, labelValues ...string) {
+	g.SetMax(float64(t.UnixNano())/1e9, labelValues...)
+}
+
+// Histogram is a metric which counts observations into buckets, such as request latencies.
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram creates and registers a histogram with the provided bucket upper bounds, in increasing order, and label
+// names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	f := newFamily(name, help, "histogram", labels)
+	f.buckets = buckets
+	return &Histogram{f: f}
+}
+
+// Observe adds an observation to the histogram for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *series) {
+		s.value += v
+		s.count++
+		for i, upperBound := range h.f.buckets {
+			if v <= upperBound {
+				s.bucketCounts[i]++
+			}
+		}
+	})
+}
+
+// ObserveDuration adds the time elapsed since start, in seconds, to the histogram for the label values.
+func (h *Histogram) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Handler serves every registered metric in the Prometheus text exposition format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	registryMu.Lock()
+	families := append([]*family(nil), registry...)
+	registryMu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, f := range families {
+		f.write(buf)
+	}
+	if err := buf.Flush(); err != nil {
+		logging.Errorf("failed to write metrics response: %s", err)
+	}
+}
+
+// write writes the family's series, ordered by their label values. Families without series are omitted.
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escape(f.help, false), f.name, f.kind)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			value := s.value
+			if f.transform != nil {
+				value = f.transform(value)
+			}
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelSet(s, "", ""), formatValue(value))
+			continue
+		}
+
+		for i, upperBound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelSet(s, "le", formatValue(upperBound)),
+				s.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelSet(s, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelSet(s, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelSet(s, "", ""), s.count)
+	}
+}
+
+// labelSet formats the series' labels, along with an extra label if provided, e.g. {route="/health",le="0.5"}.
+func (f *family) labelSet(s *series, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escape(s.labelValues[i], true)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes backslashes and newlines, along with double quotes in label values.
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,407 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+const (
+	minBackoff = time.Second * 5
+	maxBackoff = time.Minute * 10
+	// deadLetterDir is the subdirectory of the outbox directory which batches that can never be written are moved to
+	deadLetterDir = "dead"
+)
+
+// Outbox wraps an Exporter and durably spools batches which fail to be written to disk, retrying them with backoff
+// until they succeed. Spooled batches survive restarts. Batches which the Exporter rejects with storage.ErrRejected,
+// or which are corrupt, can never succeed so are moved to the dead letter directory rather than retried.
+type Outbox struct {
+	exporter sources.Exporter
+	dir      string
+
+	// writeMu serialises writes to the wrapped Exporter between Write, the retry loop and Flush, so that a new batch
+	// is never written before or while older batches are being flushed
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	pending   []string
+	seq       int
+	lastError string
+	nextRetry time.Time
+	notify    chan struct{}
+	// deadLetters is the number of batches in the dead letter directory and lastDeadLetter is the reason the most
+	// recent was moved there
+	deadLetters    int
+	lastDeadLetter string
+
+	// stopChan is closed to stop the retry loop and doneChan is closed once it has returned
+	stopOnce sync.Once
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// batch is a spooled Write call.
+type batch struct {
+	Measurement string           `json:"measurement"`
+	Results     []sources.Result `json:"results"`
+}
+
+// New initialises an Outbox which spools to the provided directory and starts retrying any batches spooled before a
+// restart.
+func New(exporter sources.Exporter, dir string) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Join(dir, deadLetterDir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox directory: %s", err)
+	}
+	deadLetters, err := ioutil.ReadDir(filepath.Join(dir, deadLetterDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox dead letter directory: %s", err)
+	}
+
+	o := &Outbox{
+		exporter:    exporter,
+		dir:         dir,
+		notify:      make(chan struct{}, 1),
+		deadLetters: len(deadLetters),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+	}
+	if o.deadLetters > 0 {
+		logging.Warnf("outbox dead letter directory contains %d batches which could not be written", o.deadLetters)
+	}
+
+	// file names are ordered by spool time, which ReadDir sorts by
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		o.pending = append(o.pending, file.Name())
+	}
+	if len(o.pending) > 0 {
+		logging.Infof("outbox found %d spooled batches to retry", len(o.pending))
+		o.notify <- struct{}{}
+	}
+
+	go o.retry()
+	return o, nil
+}
+
+// Write writes the provided data to the wrapped Exporter. If the write fails, or earlier batches are still waiting to
+// be retried, the data is spooled to disk and nil is returned as it will be written eventually.
+func (o *Outbox) Write(measurement string, results ...sources.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	// hold the write lock across the queued check and the write, so that spooled batches can't be flushed between them
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+
+	// preserve write ordering by not writing directly while there are older batches outstanding
+	if o.Depth() == 0 {
+		err := o.exporter.Write(measurement, results...)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, storage.ErrRejected) {
+			if err := o.deadLetter(batch{Measurement: measurement, Results: results}, err); err != nil {
+				return fmt.Errorf("failed to move %d rejected %s results to the outbox dead letter directory: %s",
+					len(results), measurement, err)
+			}
+			return nil
+		}
+		logging.Warnf("write failed for %s, spooling to outbox: %s", measurement, err)
+		o.setError(err)
+	}
+
+	if err := o.spool(batch{Measurement: measurement, Results: results}); err != nil {
+		return fmt.Errorf("failed to spool %d %s results to outbox: %s", len(results), measurement, err)
+	}
+	return nil
+}
+
+// spool persists a batch to the outbox directory and queues it for retrying.
+func (o *Outbox) spool(b batch) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	name, err := o.writeBatch(o.dir, b)
+	if err != nil {
+		return err
+	}
+	o.pending = append(o.pending, name)
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deadLetter persists a batch which was rejected to the dead letter directory rather than queueing it for retrying.
+func (o *Outbox) deadLetter(b batch, reason error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	name, err := o.writeBatch(filepath.Join(o.dir, deadLetterDir), b)
+	if err != nil {
+		return err
+	}
+	logging.Errorf("moved rejected %s batch %s to the outbox dead letter directory: %s", b.Measurement, name, reason)
+	o.deadLetters++
+	o.lastDeadLetter = reason.Error()
+	return nil
+}
+
+// writeBatch persists a batch to a new file in the directory, returning the file's name. The file names are ordered
+// by the time the batch was written. o.mu must be held.
+func (o *Outbox) writeBatch(dir string, b batch) (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to JSON encode batch: %s", err)
+	}
+
+	o.seq++
+	name := strconv.FormatInt(time.Now().UTC().UnixNano(), 10) + "-" + fmt.Sprintf("%06d", o.seq) + ".json"
+	if err := writeFileSync(filepath.Join(dir, name), data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// writeFileSync atomically writes a file, ensuring its contents have been flushed to disk.
+func writeFileSync(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// retry writes spooled batches to the wrapped Exporter in order, backing off exponentially while writes fail, until
+// the Outbox is closed.
+func (o *Outbox) retry() {
+	defer close(o.doneChan)
+
+	backoff := minBackoff
+	for {
+		select {
+		case <-o.notify:
+		case <-o.stopChan:
+			return
+		}
+
+		for {
+			o.mu.Lock()
+			if len(o.pending) == 0 {
+				o.nextRetry = time.Time{}
+				o.mu.Unlock()
+				break
+			}
+			name := o.pending[0]
+			o.mu.Unlock()
+
+			o.writeMu.Lock()
+			err := o.flush(name)
+			o.writeMu.Unlock()
+			if err != nil {
+				logging.Warnf("outbox retry failed for %s, retrying in %s: %s", name, backoff, err)
+				o.setError(err)
+
+				o.mu.Lock()
+				o.nextRetry = time.Now().UTC().Add(backoff)
+				o.mu.Unlock()
+
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-o.stopChan:
+					timer.Stop()
+					return
+				}
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+
+			backoff = minBackoff
+			o.setError(nil)
+		}
+	}
+}
+
+// flush writes a single spooled batch to the wrapped Exporter and removes it from the outbox.
+func (o *Outbox) flush(name string) error {
+	path := filepath.Join(o.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// already flushed by a concurrent Flush
+		o.dequeue(name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spooled batch: %s", err)
+	}
+
+	// corrupt and rejected batches can never succeed, so move them aside rather than blocking the outbox forever
+	var b batch
+	if err := json.Unmarshal(data, &b); err != nil {
+		return o.moveToDeadLetters(name, fmt.Errorf("corrupt batch: %s", err))
+	}
+	if err := o.exporter.Write(b.Measurement, b.Results...); err != nil {
+		if errors.Is(err, storage.ErrRejected) {
+			return o.moveToDeadLetters(name, err)
+		}
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove flushed batch: %s", err)
+	}
+	o.dequeue(name)
+
+	logging.Infof("outbox flushed %d %s results", len(b.Results), b.Measurement)
+	return nil
+}
+
+// moveToDeadLetters moves a spooled batch which can never be written to the dead letter directory and removes it from
+// the outbox.
+func (o *Outbox) moveToDeadLetters(name string, reason error) error {
+	if err := os.Rename(filepath.Join(o.dir, name), filepath.Join(o.dir, deadLetterDir, name)); err != nil {
+		return fmt.Errorf("failed to move batch %s to the dead letter directory: %s", name, err)
+	}
+	logging.Errorf("moved outbox batch %s to the dead letter directory: %s", name, reason)
+	o.dequeue(name)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.deadLetters++
+	o.lastDeadLetter = reason.Error()
+	return nil
+}
+
+// Flush immediately attempts to write every spooled batch to the wrapped Exporter in order, e.g. before shutting down.
+// It stops at the first batch which fails or once the context is done - any remaining batches stay spooled on disk to
+// be retried after a restart.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%d batches left spooled: %s", o.Depth(), err)
+		}
+
+		o.mu.Lock()
+		if len(o.pending) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		name := o.pending[0]
+		o.mu.Unlock()
+
+		if err := o.flush(name); err != nil {
+			o.setError(err)
+			return fmt.Errorf("%d batches left spooled: %s", o.Depth(), err)
+		}
+	}
+}
+
+// Close stops retrying spooled batches, waiting for any batch being retried to complete. Spooled batches remain on disk
+// to be retried after a restart.
+func (o *Outbox) Close() {
+	o.stopOnce.Do(func() {
+		close(o.stopChan)
+	})
+	<-o.doneChan
+}
+
+func (o *Outbox) dequeue(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, pending := range o.pending {
+		if pending == name {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o *Outbox) setError(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.lastError = ""
+	if err != nil {
+		o.lastError = err.Error()
+	}
+}
+
+// Depth returns the number of batches waiting to be written.
+func (o *Outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// State returns the outbox queue state to be displayed on the sources page.
+func (o *Outbox) State() sources.StateSet {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	state := sources.StateSet{
+		"queue_depth": len(o.pending),
+	}
+	if o.lastError != "" {
+		state["last_error"] = o.lastError
+	}
+	if !o.nextRetry.IsZero() {
+		state["next_retry"] = o.nextRetry
+	}
+	if o.deadLetters > 0 {
+		state["dead_letters"] = o.deadLetters
+		state["dead_letter_dir"] = filepath.Join(o.dir, deadLetterDir)
+	}
+	if o.lastDeadLetter != "" {
+		state["last_dead_letter_error"] = o.lastDeadLetter
+	}
+	if len(o.pending) > 0 {
+		// spool file names are prefixed with the time they were spooled
+		if nanos, err := strconv.ParseInt(strings.SplitN(o.pending[0], "-", 2)[0], 10, 64); err == nil {
+			state["oldest_batch"] = time.Unix(0, nanos).UTC()
+		}
+	}
+	return state
+}
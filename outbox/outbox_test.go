@@ -0,0 +1,318 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+// recordingExporter records the batches written to it, failing every write while err is set and rejecting writes to
+// the rejected measurement.
+type recordingExporter struct {
+	mu       sync.Mutex
+	err      error
+	rejected string
+	batches  []batch
+}
+
+func (e *recordingExporter) Write(measurement string, results ...sources.Result) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	if measurement == e.rejected {
+		return fmt.Errorf("%w: field type conflict", storage.ErrRejected)
+	}
+	e.batches = append(e.batches, batch{Measurement: measurement, Results: results})
+	return nil
+}
+
+func (e *recordingExporter) setErr(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.err = err
+}
+
+func (e *recordingExporter) written() []batch {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]batch(nil), e.batches...)
+}
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	return dir
+}
+
+func newResult(value float64) sources.Result {
+	return sources.Result{
+		Time:   time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC).Add(time.Minute * time.Duration(value)),
+		Tags:   map[string]string{"category": "groceries"},
+		Fields: map[string]interface{}{"price": value},
+	}
+}
+
+// spooledFiles returns the batch files in the outbox directory.
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("failed to list outbox directory: %s", err)
+	}
+	return files
+}
+
+// deadLetterFiles returns the batch files in the outbox dead letter directory.
+func deadLetterFiles(t *testing.T, dir string) []string {
+	return spooledFiles(t, filepath.Join(dir, deadLetterDir))
+}
+
+func TestOutboxWritesDirectly(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	exporter := &recordingExporter{}
+	o, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+
+	if err := o.Write("monzo", newResult(1)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	want := []batch{{Measurement: "monzo", Results: []sources.Result{newResult(1)}}}
+	if got := exporter.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("written batches = %+v, want %+v", got, want)
+	}
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("depth = %d, want 0", depth)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("spooled files = %v, want none", files)
+	}
+}
+
+func TestOutboxSpoolsAndFlushesInOrder(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	exporter := &recordingExporter{err: errors.New("storage unavailable")}
+	o, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+
+	// the failed write is spooled rather than returning an error
+	if err := o.Write("monzo", newResult(1)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if depth := o.Depth(); depth != 1 {
+		t.Fatalf("depth = %d, want 1", depth)
+	}
+	if state := o.State(); state["last_error"] != "storage unavailable" {
+		t.Errorf("last_error = %v, want storage unavailable", state["last_error"])
+	}
+
+	// once the exporter recovers, new batches are still spooled behind the older batch rather than overtaking it
+	exporter.setErr(nil)
+	if err := o.Write("monzo", newResult(2)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if got := exporter.written(); len(got) != 0 {
+		t.Fatalf("written batches = %+v, want none before flushing", got)
+	}
+	if files := spooledFiles(t, dir); len(files) != 2 {
+		t.Fatalf("spooled files = %v, want 2", files)
+	}
+
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	want := []batch{
+		{Measurement: "monzo", Results: []sources.Result{newResult(1)}},
+		{Measurement: "monzo", Results: []sources.Result{newResult(2)}},
+	}
+	if got := exporter.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("written batches = %+v, want %+v", got, want)
+	}
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("depth = %d, want 0", depth)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("spooled files = %v, want none", files)
+	}
+}
+
+func TestOutboxFlushStopsAtFailure(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	exporter := &recordingExporter{err: errors.New("storage unavailable")}
+	o, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+	if err := o.Write("monzo", newResult(1)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	if err := o.Flush(context.Background()); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if depth := o.Depth(); depth != 1 {
+		t.Errorf("depth = %d, want 1", depth)
+	}
+	if files := spooledFiles(t, dir); len(files) != 1 {
+		t.Errorf("spooled files = %v, want 1", files)
+	}
+}
+
+func TestOutboxReplaysAfterRestart(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	failing := &recordingExporter{err: errors.New("storage unavailable")}
+	o, err := New(failing, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := o.Write("monzo", newResult(float64(i))); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+
+	// a corrupt batch is moved to the dead letter directory rather than blocking the batches behind it
+	if err := ioutil.WriteFile(filepath.Join(dir, "9999999999999999999-000001.json"), []byte("{"), 0600); err != nil {
+		t.Fatalf("failed to write corrupt batch: %s", err)
+	}
+
+	// a new outbox for the same directory retries the spooled batches in order on start
+	exporter := &recordingExporter{}
+	restarted, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create restarted outbox: %s", err)
+	}
+	if depth := restarted.Depth(); depth != 4 {
+		t.Fatalf("depth = %d, want 4", depth)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for restarted.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if depth := restarted.Depth(); depth != 0 {
+		t.Fatalf("depth = %d, want 0 after replaying", depth)
+	}
+
+	want := []batch{
+		{Measurement: "monzo", Results: []sources.Result{newResult(1)}},
+		{Measurement: "monzo", Results: []sources.Result{newResult(2)}},
+		{Measurement: "monzo", Results: []sources.Result{newResult(3)}},
+	}
+	if got := exporter.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed batches = %+v, want %+v", got, want)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("spooled files = %v, want none", files)
+	}
+	if files := deadLetterFiles(t, dir); len(files) != 1 {
+		t.Errorf("dead letter files = %v, want 1", files)
+	}
+	if state := restarted.State(); state["dead_letters"] != 1 {
+		t.Errorf("dead_letters = %v, want 1", state["dead_letters"])
+	}
+}
+
+func TestOutboxDeadLettersRejectedBatches(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	exporter := &recordingExporter{rejected: "day_log"}
+	o, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+
+	// a rejected write is moved straight to the dead letter directory rather than spooled
+	if err := o.Write("day_log", newResult(1)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if depth := o.Depth(); depth != 0 {
+		t.Fatalf("depth = %d, want 0", depth)
+	}
+
+	// a spooled batch which is rejected once retried doesn't block the batches behind it
+	exporter.setErr(errors.New("storage unavailable"))
+	if err := o.Write("day_log", newResult(2)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := o.Write("monzo", newResult(3)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	exporter.setErr(nil)
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	want := []batch{{Measurement: "monzo", Results: []sources.Result{newResult(3)}}}
+	if got := exporter.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("written batches = %+v, want %+v", got, want)
+	}
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("depth = %d, want 0", depth)
+	}
+	if files := deadLetterFiles(t, dir); len(files) != 2 {
+		t.Errorf("dead letter files = %v, want 2", files)
+	}
+	state := o.State()
+	if state["dead_letters"] != 2 || !strings.Contains(fmt.Sprint(state["last_dead_letter_error"]), "field type") {
+		t.Errorf("state = %v, want 2 dead letters and the rejection error", state)
+	}
+}
+
+func TestOutboxCloseInterruptsBackoff(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	exporter := &recordingExporter{err: errors.New("storage unavailable")}
+	o, err := New(exporter, dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+	if err := o.Write("monzo", newResult(1)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	// wait for the retry to fail and start backing off
+	deadline := time.Now().Add(time.Second * 5)
+	for o.State()["next_retry"] == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if o.State()["next_retry"] == nil {
+		t.Fatal("expected the retry to back off")
+	}
+
+	started := time.Now()
+	o.Close()
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("close took %s, want it to interrupt the %s backoff", elapsed, minBackoff)
+	}
+	if files := spooledFiles(t, dir); len(files) != 1 {
+		t.Errorf("spooled files = %v, want the batch to remain spooled", files)
+	}
+}
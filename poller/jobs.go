@@ -0,0 +1,258 @@
+package poller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+)
+
+// maxJobHistory is the number of most recent jobs retained in the job history for each user.
+const maxJobHistory = 50
+
+// JobStatus is the status of a collection job, or of a source within a collection job.
+type JobStatus string
+
+// The collection job statuses.
+const (
+	StatusQueued    JobStatus = "queued"
+	StatusRunning   JobStatus = "running"
+	StatusSucceeded JobStatus = "succeeded"
+	StatusFailed    JobStatus = "failed"
+)
+
+// Job is a collection request and the outcome of collecting each of its sources.
+type Job struct {
+	ID string `json:"id"`
+	// User is the ID of the user whose sources are collected
+	User     string       `json:"user,omitempty"`
+	Trigger  string       `json:"trigger"`
+	Status   JobStatus    `json:"status"`
+	Created  time.Time    `json:"created"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Sources  []*SourceJob `json:"sources"`
+}
+
+// SourceJob is the outcome of collecting a single source within a Job.
+type SourceJob struct {
+	Source      string     `json:"source"`
+	Status      JobStatus  `json:"status"`
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time `json:"period_end,omitempty"`
+	Records     int        `json:"records"`
+	Error       string     `json:"error,omitempty"`
+	DurationMS  int64      `json:"duration_ms"`
+}
+
+// jobHistory records the most recent jobs, persisting them to a file so that they survive restarts.
+type jobHistory struct {
+	mu   sync.Mutex
+	path string
+	jobs []*Job
+}
+
+// newJobHistory loads the job history from the provided file. Jobs which were incomplete when the history was last
+// saved are marked as failed.
+func newJobHistory(path string) (*jobHistory, error) {
+	h := &jobHistory{
+		path: path,
+	}
+	if path == "" {
+		return h, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job history file: %s", err)
+	}
+	if err := json.Unmarshal(b, &h.jobs); err != nil {
+		return nil, fmt.Errorf("failed to JSON decode job history file: %s", err)
+	}
+
+	for _, job := range h.jobs {
+		if job.Status != StatusQueued && job.Status != StatusRunning {
+			continue
+		}
+		for _, source := range job.Sources {
+			if source.Status == StatusQueued || source.Status == StatusRunning {
+				source.Status = StatusFailed
+				source.Error = "interrupted by service restart"
+			}
+		}
+		job.Status = StatusFailed
+	}
+
+	return h, nil
+}
+
+// create records a new queued job for the provided sources of the user.
+func (h *jobHistory) create(userID, trigger string, sourceNames []string) *Job {
+	job := &Job{
+		ID:      newJobID(),
+		User:    userID,
+		Trigger: trigger,
+		Status:  StatusQueued,
+		Created: time.Now().UTC(),
+	}
+	for _, name := range sourceNames {
+		job.Sources = append(job.Sources, &SourceJob{
+			Source: name,
+			Status: StatusQueued,
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.jobs = append(h.jobs, job)
+	// drop the user's oldest job once they exceed the limit
+	var count int
+	for _, existing := range h.jobs {
+		if existing.User == userID {
+			count++
+		}
+	}
+	if count > maxJobHistory {
+		for i, existing := range h.jobs {
+			if existing.User == userID {
+				h.jobs = append(h.jobs[:i], h.jobs[i+1:]...)
+				break
+			}
+		}
+	}
+	h.save()
+	return job
+}
+
+// remove removes a job from the history, e.g. if it could not be queued.
+func (h *jobHistory) remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, job := range h.jobs {
+		if job.ID == id {
+			h.jobs = append(h.jobs[:i], h.jobs[i+1:]...)
+			break
+		}
+	}
+	h.save()
+}
+
+// update applies a change to a job and persists the history.
+func (h *jobHistory) update(job *Job, f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f()
+	h.save()
+}
+
+// finish sets the final status of a job from the status of its sources, returning the final status.
+func (h *jobHistory) finish(job *Job) JobStatus {
+	var status JobStatus
+	h.update(job, func() {
+		now := time.Now().UTC()
+		job.Finished = &now
+		job.Status = StatusSucceeded
+		for _, source := range job.Sources {
+			if source.Status != StatusSucceeded {
+				job.Status = StatusFailed
+			}
+		}
+		status = job.Status
+	})
+	return status
+}
+
+// get returns the user's JSON encoded job with the provided ID.
+func (h *jobHistory) get(userID, id string) ([]byte, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, job := range h.jobs {
+		if job.ID == id && job.User == userID {
+			b, err := json.Marshal(job)
+			return b, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// list returns the user's JSON encoded jobs, most recent first.
+func (h *jobHistory) list(userID string) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(h.jobs))
+	for i := len(h.jobs) - 1; i >= 0; i-- {
+		if h.jobs[i].User == userID {
+			jobs = append(jobs, h.jobs[i])
+		}
+	}
+	return json.Marshal(jobs)
+}
+
+// lastSucceeded returns the time that the user's most recent successful collection of the named source finished.
+func (h *jobHistory) lastSucceeded(userID, sourceName string) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var last time.Time
+	for _, job := range h.jobs {
+		if job.User != userID || job.Finished == nil || !job.Finished.After(last) {
+			continue
+		}
+		for _, sourceJob := range job.Sources {
+			if sourceJob.Source == sourceName && sourceJob.Status == StatusSucceeded {
+				last = *job.Finished
+			}
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// save persists the job history. The lock must be held by the caller.
+func (h *jobHistory) save() {
+	if h.path == "" {
+		return
+	}
+
+	b, err := json.Marshal(h.jobs)
+	if err != nil {
+		logging.Errorf("failed to JSON encode job history: %s", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		logging.Errorf("failed to create job history directory: %s", err)
+		return
+	}
+	tmpPath := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		logging.Errorf("failed to write job history file: %s", err)
+		return
+	}
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		logging.Errorf("failed to replace job history file: %s", err)
+	}
+}
+
+// newJobID generates a random job ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to a time based ID, which is unique enough given collections are serialised
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
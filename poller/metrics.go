@@ -0,0 +1,17 @@
+package poller
+
+import (
+	"github.com/jemgunay/life-metrics/metrics"
+)
+
+var (
+	collectionRuns = metrics.NewCounter("life_metrics_collection_runs_total",
+		"Source collections, by source, user and status.", "source", "user", "status")
+	collectionDuration = metrics.NewHistogram("life_metrics_collection_duration_seconds",
+		"Time taken to collect sources, by source and user.", []float64{1, 5, 15, 30, 60, 120, 300, 600},
+		"source", "user")
+	collectionRecords = metrics.NewCounter("life_metrics_collection_records_total",
+		"Records collected from sources, by source and user.", "source", "user")
+	collectionLastSuccess = metrics.NewGauge("life_metrics_collection_last_success_timestamp_seconds",
+		"Unix time of the last successful collection, by source and user.", "source", "user")
+)
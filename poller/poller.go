@@ -0,0 +1,564 @@
+package poller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/auth"
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/outbox"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+	"github.com/jemgunay/life-metrics/users"
+)
+
+// resetStart is the start of reset collections and of the first collection of a source with no stored records, which
+// is before the data of any source.
+var resetStart = time.Date(2000, 0, 0, 0, 0, 0, 0, time.UTC)
+
+// collectRequest specifies collection details.
+type collectRequest struct {
+	// user is the ID of the user whose sources are collected
+	user  string
+	reset bool
+	// sources limits the collection to the named sources - all sources are collected if empty
+	sources []string
+	// start and end limit the collection to a time period - if unset, each source is collected from its last
+	// collected record until now
+	start time.Time
+	end   time.Time
+	// job tracks the outcome of the collection
+	job *Job
+}
+
+// includes determines if the request covers the named source.
+func (c collectRequest) includes(name string) bool {
+	if len(c.sources) == 0 {
+		return true
+	}
+	for _, source := range c.sources {
+		if source == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Poller serialises access to source operations and automatically collects sources on their configured schedules. Each
+// user has their own instance of each source.
+type Poller struct {
+	store      storage.Store
+	outbox     *outbox.Outbox
+	location   *time.Location
+	jitter     time.Duration
+	users      []users.User
+	sources    []*scheduledSource
+	jobs       *jobHistory
+	scrapeChan chan collectRequest
+
+	// stopChan is closed to stop accepting collections, abortChan is closed to cancel the in progress collection and
+	// doneChan is closed once Start has returned
+	stopOnce  sync.Once
+	stopChan  chan struct{}
+	abortOnce sync.Once
+	abortChan chan struct{}
+	doneChan  chan struct{}
+}
+
+// scheduledSource tracks the schedule and run times of a user's instance of a source.
+type scheduledSource struct {
+	sources.Source
+	user     string
+	schedule schedule
+	// timeout is the deadline for each collection of the source - collections are not limited if zero
+	timeout time.Duration
+
+	mu      sync.Mutex
+	lastRun time.Time
+	nextRun time.Time
+}
+
+// String identifies the source and the user it is collected for in logs.
+func (s *scheduledSource) String() string {
+	if s.user == users.DefaultID {
+		return s.Name()
+	}
+	return s.Name() + " for user " + s.user
+}
+
+// SourceFactory creates a user's instance of a source, which writes the data it collects to exporter.
+type SourceFactory func(user users.User, exporter sources.Exporter) (sources.Source, error)
+
+// New initialises a Poller. Cron schedules are evaluated in the provided location and each scheduled collection is
+// delayed by a random duration of up to jitter to avoid collecting from every source at exactly the same time. Recent
+// collection jobs are persisted to the job history file. Sources are collected for each of the provided users.
+func New(store storage.Store, sourceOutbox *outbox.Outbox, loc *time.Location, jitter time.Duration,
+	jobHistoryPath string, userList []users.User) (*Poller, error) {
+
+	jobs, err := newJobHistory(jobHistoryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load job history: %s", err)
+	}
+
+	return &Poller{
+		store:      store,
+		outbox:     sourceOutbox,
+		location:   loc,
+		jitter:     jitter,
+		users:      userList,
+		jobs:       jobs,
+		scrapeChan: make(chan collectRequest, 1),
+		stopChan:   make(chan struct{}),
+		abortChan:  make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}, nil
+}
+
+// Add adds a source to the Poller, creating an instance of it for each user with the factory. Each instance writes
+// to the outbox with its data tagged with the user. The source is collected on the provided schedule expression (see
+// parseSchedule), or only on request if there is no schedule. Each collection of the source is cancelled if it takes
+// longer than timeout.
+func (p *Poller) Add(factory SourceFactory, scheduleExpr string, timeout time.Duration) error {
+	sched, err := parseSchedule(scheduleExpr, p.location)
+	if err != nil {
+		return fmt.Errorf("failed to parse schedule: %s", err)
+	}
+
+	for _, user := range p.users {
+		source, err := factory(user, storage.UserExporter(p.outbox, user.ID))
+		if err != nil {
+			return fmt.Errorf("failed to create source for user %q: %s", user.ID, err)
+		}
+
+		p.sources = append(p.sources, &scheduledSource{
+			Source:   source,
+			user:     user.ID,
+			schedule: sched,
+			timeout:  timeout,
+		})
+
+		// expose the source's collection metrics before its first collection, restoring its last success from the job
+		// history so that alerts on collections which have stopped succeeding survive restarts
+		collectionRuns.Add(0, source.Name(), user.ID, string(StatusSucceeded))
+		collectionRuns.Add(0, source.Name(), user.ID, string(StatusFailed))
+		if lastSuccess, ok := p.jobs.lastSucceeded(user.ID, source.Name()); ok {
+			collectionLastSuccess.SetTime(lastSuccess, source.Name(), user.ID)
+		}
+	}
+	return nil
+}
+
+// Start starts the source schedulers then polls for scrape requests and performs collections for each source until
+// the context is done, which also cancels any in progress collection, or until the Poller is shut down.
+func (p *Poller) Start(ctx context.Context) {
+	defer close(p.doneChan)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.abortChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, source := range p.sources {
+		if source.schedule != nil {
+			go p.schedule(ctx, source)
+		}
+	}
+
+	for {
+		select {
+		case req := <-p.scrapeChan:
+			p.collect(ctx, req)
+		case <-p.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown stops the Poller from starting any further collections and waits for the in progress collection to
+// complete. If the context is done first, the in progress collection is cancelled and the context's error is returned
+// once it has stopped. Queued collections are left queued in the job history. Start must have been called.
+func (p *Poller) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+	})
+
+	select {
+	case <-p.doneChan:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.abortOnce.Do(func() {
+		close(p.abortChan)
+	})
+	<-p.doneChan
+	return ctx.Err()
+}
+
+// collect performs a collection for each source covered by the request, recording the outcome of each against the
+// request's job.
+func (p *Poller) collect(ctx context.Context, req collectRequest) {
+	endTime := time.Now().UTC()
+	if !req.end.IsZero() {
+		endTime = req.end
+	}
+
+	p.jobs.update(req.job, func() {
+		req.job.Status = StatusRunning
+	})
+
+	for _, sourceJob := range req.job.Sources {
+		source := p.source(req.user, sourceJob.Source)
+		started := time.Now()
+
+		p.jobs.update(req.job, func() {
+			sourceJob.Status = StatusRunning
+		})
+
+		records, err := p.collectSource(ctx, source, sourceJob, req, endTime)
+
+		collectionDuration.ObserveDuration(started, source.Name(), source.user)
+		collectionRecords.Add(float64(records), source.Name(), source.user)
+		if err != nil {
+			collectionRuns.Inc(source.Name(), source.user, string(StatusFailed))
+		} else {
+			collectionRuns.Inc(source.Name(), source.user, string(StatusSucceeded))
+			collectionLastSuccess.SetTime(time.Now(), source.Name(), source.user)
+		}
+
+		p.jobs.update(req.job, func() {
+			sourceJob.DurationMS = time.Since(started).Milliseconds()
+			sourceJob.Records = records
+			sourceJob.Status = StatusSucceeded
+			if err != nil {
+				logging.Errorf("failed to collect source %s: %s", source, err)
+				sourceJob.Status = StatusFailed
+				sourceJob.Error = err.Error()
+			}
+		})
+	}
+
+	status := p.jobs.finish(req.job)
+	logging.Infof("collection job %s finished with status %s", req.job.ID, status)
+}
+
+// collectSource collects a single source from the start of the requested period until endTime.
+func (p *Poller) collectSource(ctx context.Context, source *scheduledSource, sourceJob *SourceJob,
+	req collectRequest, endTime time.Time) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var startTime time.Time
+	var resumed bool
+	switch {
+	case req.reset:
+		startTime = resetStart
+
+	case !req.start.IsZero():
+		startTime = req.start
+
+	default:
+		var err error
+		startTime, err = p.store.ForUser(source.user).LastTimestampByMeasurement(source.Name())
+		switch {
+		case errors.Is(err, storage.ErrNoResults):
+			// nothing has been collected yet, so collect everything as for a reset
+			logging.Infof("no records stored for source %s, collecting from %s", source, resetStart)
+			startTime = resetStart
+		case err != nil:
+			return 0, fmt.Errorf("failed to get last timestamp: %s", err)
+		default:
+			// add a second to ensure we don't recollect the last record
+			startTime = startTime.Add(time.Second)
+			resumed = true
+		}
+	}
+
+	source.mu.Lock()
+	source.lastRun = time.Now().UTC()
+	source.mu.Unlock()
+
+	startTime, endTime = startTime.UTC(), endTime.UTC()
+	p.jobs.update(req.job, func() {
+		sourceJob.PeriodStart = &startTime
+		sourceJob.PeriodEnd = &endTime
+	})
+
+	if source.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, source.timeout)
+		defer cancel()
+	}
+
+	period := sources.NewPeriod(startTime, endTime)
+	period.Resumed = resumed
+	records, err := source.Collect(ctx, period)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("collection timed out after %s: %s", source.timeout, err)
+	}
+	return records, err
+}
+
+// schedule requests a collection of the source each time it is scheduled until the context is done.
+func (p *Poller) schedule(ctx context.Context, source *scheduledSource) {
+	logging.Infof("scheduling collection for source %s: %s", source, source.schedule)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		now := time.Now()
+		next := source.schedule.next(now)
+		if next.IsZero() {
+			logging.Warnf("schedule for source %s never runs, disabling schedule", source)
+			return
+		}
+		if p.jitter > 0 {
+			next = next.Add(time.Duration(random.Int63n(int64(p.jitter))))
+		}
+
+		source.mu.Lock()
+		source.nextRun = next.UTC()
+		source.mu.Unlock()
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-p.stopChan:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// wait for any in progress collection to complete rather than dropping the scheduled collection
+		logging.Infof("starting scheduled collection for source %s", source)
+		req := collectRequest{
+			user:    source.user,
+			sources: []string{source.Name()},
+			job:     p.jobs.create(source.user, "schedule", []string{source.Name()}),
+		}
+		select {
+		case p.scrapeChan <- req:
+		case <-p.stopChan:
+			p.jobs.remove(req.job.ID)
+			return
+		case <-ctx.Done():
+			p.jobs.remove(req.job.ID)
+			return
+		}
+	}
+}
+
+// collectResponse is the response to an accepted collection request.
+type collectResponse struct {
+	JobID string `json:"job_id"`
+}
+
+// CollectHandler triggers a collection of all of the authenticated user's sources, or of the sources and time period
+// specified by the source, start and end queries, responding with the ID of the collection job. A GET lists the
+// user's recent collection jobs.
+func (p *Poller) CollectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserID(r.Context())
+	if r.Method == http.MethodGet {
+		b, err := p.jobs.list(userID)
+		if err != nil {
+			logging.Errorf("failed to JSON marshal collection jobs: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := p.parseCollectRequest(r, userID)
+	if err != nil {
+		logging.Errorf("failed to process collect request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	names := req.sources
+	if len(names) == 0 {
+		for _, source := range p.sources {
+			if source.user == userID {
+				names = append(names, source.Name())
+			}
+		}
+	}
+	req.job = p.jobs.create(userID, "manual", names)
+
+	select {
+	case p.scrapeChan <- req:
+	default:
+		p.jobs.remove(req.job.ID)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	b, err := json.Marshal(collectResponse{JobID: req.job.ID})
+	if err != nil {
+		logging.Errorf("failed to JSON marshal collect response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", r.URL.Path+"/"+req.job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+// JobHandler serves the status of the authenticated user's collection job with the ID provided in the request path,
+// i.e. /api/data/collect/{id}.
+func (p *Poller) JobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	b, ok, err := p.jobs.get(auth.UserID(r.Context()), id)
+	if err != nil {
+		logging.Errorf("failed to JSON marshal collection job: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (p *Poller) parseCollectRequest(r *http.Request, userID string) (collectRequest, error) {
+	q := r.URL.Query()
+	req := collectRequest{
+		user:    userID,
+		reset:   q.Get("reset") == "true",
+		sources: q["source"],
+	}
+
+	for _, name := range req.sources {
+		if p.source(userID, name) == nil {
+			return collectRequest{}, fmt.Errorf("unknown source %q", name)
+		}
+	}
+
+	var err error
+	if start := q.Get("start"); start != "" {
+		if req.start, err = parseTime(start, p.userLocation(userID)); err != nil {
+			return collectRequest{}, fmt.Errorf("invalid start query: %s", err)
+		}
+	}
+	if end := q.Get("end"); end != "" {
+		if req.end, err = parseTime(end, p.userLocation(userID)); err != nil {
+			return collectRequest{}, fmt.Errorf("invalid end query: %s", err)
+		}
+		if req.start.IsZero() {
+			return collectRequest{}, errors.New("end query provided without a start query")
+		}
+	}
+
+	if !req.start.IsZero() {
+		if req.reset {
+			return collectRequest{}, errors.New("reset cannot be combined with a start query")
+		}
+		if !req.end.IsZero() && !req.end.After(req.start) {
+			return collectRequest{}, errors.New("end must be after start")
+		}
+	}
+
+	return req, nil
+}
+
+// userLocation returns the location that the user's dates are parsed in, which defaults to the Poller's location.
+func (p *Poller) userLocation(userID string) *time.Location {
+	for _, user := range p.users {
+		if user.ID == userID && user.Location != nil {
+			return user.Location
+		}
+	}
+	return p.location
+}
+
+// source returns the user's instance of the source with the provided name, or nil if there is no such source.
+func (p *Poller) source(userID, name string) *scheduledSource {
+	for _, source := range p.sources {
+		if source.user == userID && source.Name() == name {
+			return source
+		}
+	}
+	return nil
+}
+
+// parseTime parses an RFC3339 timestamp, or a local date (e.g. 2021-03-01) as the start of that day in the provided
+// location.
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse %s as a date or RFC3339 timestamp", value)
+	}
+	return t, nil
+}
+
+// SourcesHandler serves the state of each of the authenticated user's sources, including its schedule. The outbox is
+// shared by every user, so its state, including its errors, is only served to the default user.
+func (p *Poller) SourcesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserID(r.Context())
+	resp := make(map[string]sources.StateSet)
+	for _, source := range p.sources {
+		if source.user != userID {
+			continue
+		}
+		state := source.State()
+
+		source.mu.Lock()
+		state["schedule"] = nil
+		if source.schedule != nil {
+			state["schedule"] = source.schedule.String()
+			state["next_run"] = source.nextRun
+		}
+		if !source.lastRun.IsZero() {
+			state["last_run"] = source.lastRun
+		}
+		source.mu.Unlock()
+
+		resp[source.Name()] = state
+	}
+	if userID == users.DefaultID {
+		resp["outbox"] = p.outbox.State()
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logging.Errorf("failed to JSON marshal source state: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
@@ -0,0 +1,128 @@
+package poller
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/auth"
+	"github.com/jemgunay/life-metrics/disk"
+	"github.com/jemgunay/life-metrics/outbox"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/users"
+)
+
+// recordingSource records the periods it is collected for.
+type recordingSource struct {
+	periods []sources.Period
+}
+
+func (s *recordingSource) Name() string {
+	return "recording"
+}
+
+func (s *recordingSource) Collect(_ context.Context, period sources.Period) (int, error) {
+	s.periods = append(s.periods, period)
+	return 0, nil
+}
+
+func (s *recordingSource) State() sources.StateSet {
+	return sources.StateSet{}
+}
+
+// newTestPoller creates a poller for the users which stores to a disk store.
+func newTestPoller(t *testing.T, pollerUsers []users.User) (*Poller, *disk.Store, func()) {
+	dir, err := ioutil.TempDir("", "poller")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	store, err := disk.New(filepath.Join(dir, "life-metrics.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	sourceOutbox, err := outbox.New(store, filepath.Join(dir, "outbox"))
+	if err != nil {
+		t.Fatalf("failed to create outbox: %s", err)
+	}
+	p, err := New(store, sourceOutbox, time.UTC, 0, "", pollerUsers)
+	if err != nil {
+		t.Fatalf("failed to create poller: %s", err)
+	}
+	return p, store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCollectFirstRun(t *testing.T) {
+	p, store, cleanup := newTestPoller(t, []users.User{{ID: users.DefaultID}})
+	defer cleanup()
+
+	source := &recordingSource{}
+	err := p.Add(func(users.User, sources.Exporter) (sources.Source, error) {
+		return source, nil
+	}, "", 0)
+	if err != nil {
+		t.Fatalf("failed to add source: %s", err)
+	}
+
+	// a scheduled collection requests no start, as it is collected from the last stored record
+	collect := func() *Job {
+		req := collectRequest{
+			user:    users.DefaultID,
+			sources: []string{source.Name()},
+			job:     p.jobs.create(users.DefaultID, "schedule", []string{source.Name()}),
+		}
+		p.collect(context.Background(), req)
+		return req.job
+	}
+
+	// nothing has been stored for the source yet, so everything is collected
+	if job := collect(); job.Status != StatusSucceeded {
+		t.Fatalf("first collection job status = %s, error %q, want %s", job.Status, job.Sources[0].Error,
+			StatusSucceeded)
+	}
+	if len(source.periods) != 1 || !source.periods[0].Start.Equal(resetStart) || source.periods[0].Resumed {
+		t.Fatalf("first collection periods = %+v, want a start of %s", source.periods, resetStart)
+	}
+
+	last := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	result := sources.Result{Time: last, Fields: map[string]interface{}{"value": 1}}
+	if err := store.Write(source.Name(), result); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if job := collect(); job.Status != StatusSucceeded {
+		t.Fatalf("second collection job status = %s, want %s", job.Status, StatusSucceeded)
+	}
+	want := last.Add(time.Second)
+	if len(source.periods) != 2 || !source.periods[1].Start.Equal(want) || !source.periods[1].Resumed {
+		t.Errorf("second collection periods = %+v, want a resumed start of %s", source.periods, want)
+	}
+}
+
+func TestSourcesHandlerOutboxState(t *testing.T) {
+	p, _, cleanup := newTestPoller(t, []users.User{{ID: users.DefaultID}, {ID: "alice"}})
+	defer cleanup()
+
+	// the outbox is shared by every user, so only the default user is shown its state
+	for userID, want := range map[string]bool{users.DefaultID: true, "alice": false} {
+		req := httptest.NewRequest(http.MethodGet, "/api/data/sources", nil)
+		req = req.WithContext(auth.WithUserID(req.Context(), userID))
+		w := httptest.NewRecorder()
+		p.SourcesHandler(w, req)
+
+		var resp map[string]sources.StateSet
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode sources for user %q: %s", userID, err)
+		}
+		if _, ok := resp["outbox"]; ok != want {
+			t.Errorf("sources for user %q include the outbox state = %t, want %t", userID, ok, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package poller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule determines when a source is next automatically collected.
+type schedule interface {
+	// next returns the first scheduled time after the provided time.
+	next(t time.Time) time.Time
+	String() string
+}
+
+// parseSchedule parses a schedule expression, which is either an interval (e.g. "6h" or "@every 6h"), one of the
+// "@hourly", "@daily" or "@weekly" shorthands, or a standard 5 field cron expression (e.g. "0 */6 * * *") evaluated in
+// the provided location. An empty expression or "off" disables scheduling and returns a nil schedule.
+func parseSchedule(expr string, loc *time.Location) (schedule, error) {
+	expr = strings.TrimSpace(expr)
+	switch expr {
+	case "", "off":
+		return nil, nil
+	case "@hourly":
+		expr = "0 * * * *"
+	case "@daily":
+		expr = "0 0 * * *"
+	case "@weekly":
+		expr = "0 0 * * 0"
+	}
+
+	if d, err := time.ParseDuration(strings.TrimPrefix(expr, "@every ")); err == nil {
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval %s must be at least 1m", d)
+		}
+		return interval(d), nil
+	}
+
+	return parseCron(expr, loc)
+}
+
+// ValidateSchedule checks that a schedule expression can be parsed (see parseSchedule).
+func ValidateSchedule(expr string, loc *time.Location) error {
+	_, err := parseSchedule(expr, loc)
+	return err
+}
+
+// interval is a schedule which runs at a fixed interval.
+type interval time.Duration
+
+func (i interval) next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+func (i interval) String() string {
+	return "@every " + time.Duration(i).String()
+}
+
+// cron is a schedule defined by a standard 5 field cron expression.
+type cron struct {
+	expr    string
+	loc     *time.Location
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+// cronFields defines the valid range of each cron field.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+func parseCron(expr string, loc *time.Location) (cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return cron{}, fmt.Errorf("invalid schedule %q: expected an interval or a cron expression with 5 fields", expr)
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return cron{}, fmt.Errorf("invalid %s field in schedule %q: %s", cronFields[i].name, expr, err)
+		}
+	}
+
+	return cron{
+		expr:    expr,
+		loc:     loc,
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps (e.g. "*/15", "1-5", "0,30") into a bit
+// set of the matching values.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// a single value with a step, e.g. "5/15", runs from the value to the end of the range
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside of the range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	if bits == 0 {
+		return 0, errors.New("no values")
+	}
+	return bits, nil
+}
+
+func (c cron) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+
+	// give up if no match is found within 5 years, e.g. for 31st February
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches follows the standard cron behaviour of matching either the day of month or day of week field if both
+// are restricted.
+func (c cron) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func (c cron) String() string {
+	return c.expr
+}
@@ -0,0 +1,108 @@
+package poller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "", want: ""},
+		{expr: "off", want: ""},
+		{expr: "6h", want: "@every 6h0m0s"},
+		{expr: "@every 30m", want: "@every 30m0s"},
+		{expr: "@hourly", want: "0 * * * *"},
+		{expr: "@daily", want: "0 0 * * *"},
+		{expr: "@weekly", want: "0 0 * * 0"},
+		{expr: "0 */6 * * *", want: "0 */6 * * *"},
+		{expr: " 15,45 9-17 * * 1-5 ", want: "15,45 9-17 * * 1-5"},
+		{expr: "30s", wantErr: true},
+		{expr: "@every 1x", wantErr: true},
+		{expr: "0 * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 7", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+	}
+
+	for _, test := range tests {
+		s, err := parseSchedule(test.expr, time.UTC)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseSchedule(%q) expected an error, got %v", test.expr, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSchedule(%q) returned an error: %s", test.expr, err)
+			continue
+		}
+
+		var got string
+		if s != nil {
+			got = s.String()
+		}
+		if got != test.want {
+			t.Errorf("parseSchedule(%q) = %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+
+	// a Wednesday
+	from := time.Date(2021, 3, 3, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		loc  *time.Location
+		from time.Time
+		want time.Time
+	}{
+		{expr: "@every 6h", loc: time.UTC, from: from, want: from.Add(time.Hour * 6)},
+		{expr: "*/15 * * * *", loc: time.UTC, from: from, want: time.Date(2021, 3, 3, 10, 30, 0, 0, time.UTC)},
+		{expr: "@hourly", loc: time.UTC, from: from, want: time.Date(2021, 3, 3, 11, 0, 0, 0, time.UTC)},
+		{expr: "@daily", loc: time.UTC, from: from, want: time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{expr: "@weekly", loc: time.UTC, from: from, want: time.Date(2021, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 */6 * * *", loc: time.UTC, from: from, want: time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC)},
+		// the next run is strictly after the provided time
+		{expr: "0 12 * * *", loc: time.UTC, from: time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)},
+		{expr: "5/20 * * * *", loc: time.UTC, from: from, want: time.Date(2021, 3, 3, 10, 25, 0, 0, time.UTC)},
+		{expr: "0 9 * * 1-5", loc: time.UTC, from: time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC),
+			want: time.Date(2021, 3, 8, 9, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1 */3 *", loc: time.UTC, from: from, want: time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", loc: time.UTC, from: from, want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week matches if both are restricted
+		{expr: "0 0 15 * 5", loc: time.UTC, from: from, want: time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC)},
+		// cron expressions are evaluated in the location, which is BST (UTC+1) in June
+		{expr: "0 9 * * *", loc: london, from: time.Date(2021, 6, 1, 7, 0, 0, 0, time.UTC),
+			want: time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{expr: "0 9 * * *", loc: london, from: time.Date(2021, 1, 1, 7, 0, 0, 0, time.UTC),
+			want: time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)},
+		// no match is found for impossible dates
+		{expr: "0 0 31 2 *", loc: time.UTC, from: from, want: time.Time{}},
+	}
+
+	for _, test := range tests {
+		s, err := parseSchedule(test.expr, test.loc)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) returned an error: %s", test.expr, err)
+			continue
+		}
+		if got := s.next(test.from); !got.Equal(test.want) {
+			t.Errorf("next run of %q after %s = %s, want %s", test.expr, test.from, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Type is a day log metric type.
+type Type string
+
+// The supported metric types.
+const (
+	// TypeScale is an integer within an inclusive range, e.g. a 0 to 10 slider.
+	TypeScale Type = "scale"
+	// TypeBool is a yes/no checkbox.
+	TypeBool Type = "bool"
+	// TypeNumber is a decimal number, optionally bounded by a range.
+	TypeNumber Type = "number"
+	// TypeText is free text. Text metrics do not contribute to the score.
+	TypeText Type = "text"
+)
+
+// Schema declares the metrics which make up a day log.
+type Schema struct {
+	Metrics []Metric `yaml:"metrics" json:"metrics"`
+}
+
+// Metric declares a single day log metric and how it contributes to the day log score.
+type Metric struct {
+	Name  string `yaml:"name" json:"name"`
+	Label string `yaml:"label" json:"label"`
+	Type  Type   `yaml:"type" json:"type"`
+	// Min and Max define the inclusive range of a scale or number metric. They are required for scale metrics and
+	// for scored number metrics.
+	Min *float64 `yaml:"min,omitempty" json:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty" json:"max,omitempty"`
+	// Inverted metrics score higher for lower values. Inverted scale values are also stored inverted so that a higher
+	// value is always better when visualised.
+	Inverted bool `yaml:"inverted" json:"inverted"`
+	// Weight is the maximum score the metric contributes to the day log score.
+	Weight  int         `yaml:"weight" json:"weight"`
+	Default interface{} `yaml:"default,omitempty" json:"default,omitempty"`
+}
+
+// Load reads and validates a YAML schema file. If no path is provided, the default schema is returned.
+func Load(path string) (Schema, error) {
+	if path == "" {
+		return Default(), nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Schema{}, fmt.Errorf("failed to read schema file: %s", err)
+	}
+
+	var s Schema
+	if err := yaml.UnmarshalStrict(b, &s); err != nil {
+		return Schema{}, fmt.Errorf("failed to YAML decode schema file: %s", err)
+	}
+
+	// yaml decodes maps as map[interface{}]interface{} which cannot be JSON encoded, so only scalar defaults are
+	// supported
+	for i := range s.Metrics {
+		switch v := s.Metrics[i].Default.(type) {
+		case nil, bool, int, float64, string:
+		default:
+			return Schema{}, fmt.Errorf("metric %s has an unsupported default value %v", s.Metrics[i].Name, v)
+		}
+	}
+
+	if err := s.Validate(); err != nil {
+		return Schema{}, fmt.Errorf("invalid schema: %s", err)
+	}
+
+	return s, nil
+}
+
+// reservedNames are day log fields which are not metrics, so cannot be used as metric names.
+var reservedNames = map[string]struct{}{
+	"notes":           {},
+	"submission_date": {},
+	"score_value":     {},
+	"score_max":       {},
+	"score_health":    {},
+}
+
+// Validate checks that the schema is well formed.
+func (s Schema) Validate() error {
+	if len(s.Metrics) == 0 {
+		return errors.New("no metrics defined")
+	}
+
+	names := make(map[string]struct{}, len(s.Metrics))
+	for _, m := range s.Metrics {
+		if m.Name == "" {
+			return errors.New("metric defined with no name")
+		}
+		if _, ok := reservedNames[m.Name]; ok {
+			return fmt.Errorf("metric name %s is reserved", m.Name)
+		}
+		if _, ok := names[m.Name]; ok {
+			return fmt.Errorf("metric %s defined more than once", m.Name)
+		}
+		names[m.Name] = struct{}{}
+
+		if m.Weight < 0 {
+			return fmt.Errorf("metric %s has a negative weight", m.Name)
+		}
+		if (m.Min == nil) != (m.Max == nil) {
+			return fmt.Errorf("metric %s must define both min and max, or neither", m.Name)
+		}
+		if m.Min != nil && *m.Max <= *m.Min {
+			return fmt.Errorf("metric %s max must be greater than min", m.Name)
+		}
+
+		switch m.Type {
+		case TypeScale:
+			if m.Min == nil {
+				return fmt.Errorf("scale metric %s requires a min and max", m.Name)
+			}
+			if *m.Min != math.Trunc(*m.Min) || *m.Max != math.Trunc(*m.Max) {
+				return fmt.Errorf("scale metric %s requires an integer min and max", m.Name)
+			}
+		case TypeNumber:
+			if m.Weight > 0 && m.Min == nil {
+				return fmt.Errorf("scored number metric %s requires a min and max", m.Name)
+			}
+		case TypeBool:
+			if m.Min != nil {
+				return fmt.Errorf("bool metric %s cannot define a range", m.Name)
+			}
+		case TypeText:
+			if m.Min != nil || m.Weight > 0 || m.Inverted {
+				return fmt.Errorf("text metric %s cannot define a range, weight or be inverted", m.Name)
+			}
+		default:
+			return fmt.Errorf("metric %s has unsupported type %q", m.Name, m.Type)
+		}
+	}
+
+	return nil
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+// Default returns the default day log schema.
+func Default() Schema {
+	return Schema{
+		Metrics: []Metric{
+			{Name: "general_mood", Label: "General Mood", Type: TypeScale, Min: float(0), Max: float(10), Weight: 10, Default: 5},
+			{Name: "diet_quality", Label: "Diet Quality", Type: TypeScale, Min: float(0), Max: float(10), Weight: 10, Default: 5},
+			{Name: "water_intake", Label: "Water Intake", Type: TypeScale, Min: float(0), Max: float(10), Weight: 10, Default: 5},
+			{Name: "caffeine_intake", Label: "Caffeine Intake", Type: TypeScale, Min: float(0), Max: float(10), Inverted: true, Weight: 10, Default: 1},
+			{Name: "exercise", Label: "Exercise", Type: TypeBool, Weight: 5, Default: false},
+			{Name: "meditation", Label: "Meditation", Type: TypeBool, Weight: 5, Default: false},
+		},
+	}
+}
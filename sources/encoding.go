@@ -0,0 +1,146 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// resultJSON is the JSON representation of a Result. Field values are encoded alongside their type so that integer
+// and float fields survive a round trip, as InfluxDB rejects writes which change the type of an existing field.
+type resultJSON struct {
+	Time   time.Time            `json:"time"`
+	Tags   map[string]string    `json:"tags,omitempty"`
+	Fields map[string]fieldJSON `json:"fields"`
+}
+
+type fieldJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+const (
+	fieldTypeBool   = "bool"
+	fieldTypeInt    = "int"
+	fieldTypeUint   = "uint"
+	fieldTypeFloat  = "float"
+	fieldTypeString = "string"
+)
+
+// MarshalJSON encodes the Result as JSON, preserving the type of each field value.
+func (r Result) MarshalJSON() ([]byte, error) {
+	res := resultJSON{
+		Time:   r.Time,
+		Tags:   r.Tags,
+		Fields: make(map[string]fieldJSON, len(r.Fields)),
+	}
+
+	for name, value := range r.Fields {
+		value = NormaliseField(value)
+
+		var fieldType string
+		switch value.(type) {
+		case bool:
+			fieldType = fieldTypeBool
+		case int64:
+			fieldType = fieldTypeInt
+		case uint64:
+			fieldType = fieldTypeUint
+		case float64:
+			fieldType = fieldTypeFloat
+		default:
+			fieldType = fieldTypeString
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to JSON encode field %s: %s", name, err)
+		}
+		res.Fields[name] = fieldJSON{
+			Type:  fieldType,
+			Value: b,
+		}
+	}
+
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON decodes a Result encoded by MarshalJSON.
+func (r *Result) UnmarshalJSON(b []byte) error {
+	var res resultJSON
+	if err := json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+
+	r.Time = res.Time
+	r.Tags = res.Tags
+	r.Fields = make(map[string]interface{}, len(res.Fields))
+
+	for name, field := range res.Fields {
+		var err error
+		switch field.Type {
+		case fieldTypeBool:
+			var v bool
+			err = json.Unmarshal(field.Value, &v)
+			r.Fields[name] = v
+		case fieldTypeInt:
+			var v int64
+			err = json.Unmarshal(field.Value, &v)
+			r.Fields[name] = v
+		case fieldTypeUint:
+			var v uint64
+			err = json.Unmarshal(field.Value, &v)
+			r.Fields[name] = v
+		case fieldTypeFloat:
+			var v float64
+			err = json.Unmarshal(field.Value, &v)
+			r.Fields[name] = v
+		case fieldTypeString:
+			var v string
+			err = json.Unmarshal(field.Value, &v)
+			r.Fields[name] = v
+		default:
+			err = fmt.Errorf("unsupported field type %s", field.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to JSON decode field %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// NormaliseField converts a field value into the type it would be stored as by InfluxDB, i.e. one of bool, int64,
+// uint64, float64 or string.
+func NormaliseField(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bool, int64, uint64, float64, string:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case uint:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -1,13 +1,19 @@
 package monzo
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
+
+	"github.com/jemgunay/life-metrics/auth"
+	"github.com/jemgunay/life-metrics/logging"
 )
 
 type authAccessDetails struct {
@@ -17,30 +23,121 @@ type authAccessDetails struct {
 	RefreshToken string `json:"refresh_token"`
 	TokenType    string `json:"token_type"`
 	UserID       string `json:"user_id"`
+	// ObtainedAt is when the access token was fetched, which ExpiresIn is relative to.
+	ObtainedAt time.Time `json:"obtained_at"`
+}
+
+// expiry returns when the access token expires.
+func (a authAccessDetails) expiry() time.Time {
+	return a.ObtainedAt.Add(time.Second * time.Duration(a.ExpiresIn))
 }
 
+// refreshIn determines how long until the access token should be refreshed, which is 5 minutes before it expires.
+func (a authAccessDetails) refreshIn() time.Duration {
+	return time.Until(a.expiry()) - time.Minute*5
+}
+
+const (
+	// stateCookie binds the OAuth state to the browser which started the authentication sequence
+	stateCookie = "monzo_oauth_state"
+	stateTTL    = time.Minute * 10
+	// failed refreshes are retried with exponential backoff between these durations until the access token expires
+	minRefreshBackoff = time.Second * 15
+	maxRefreshBackoff = time.Minute * 2
+)
+
 // AuthenticateHandler starts the OAuth2 authentication sequence, requesting a temporary access code from Monzo. This
-// endpoint also receives callback requests from Monzo with the temporary access code.
+// endpoint also receives callback requests from Monzo with the temporary access code. The callback is only accepted
+// with the signed state value generated for the browser which started the sequence, and the outcome is reported to
+// the web app via the auth or auth_error query.
 func (m *Monzo) AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 	// first step of oauth - request a temporary access code from monzo
-	code := r.URL.Query().Get("code")
-	if code == "" {
-		q := url.Values{}
-		q.Set("client_id", m.currentAuth.ClientID)
-		q.Set("redirect_uri", m.serviceRedirectURL)
-		q.Set("response_type", "code")
-		authURL := "https://auth.monzo.com?" + q.Encode()
+	q := r.URL.Query()
+	if q.Get("code") == "" && q.Get("error") == "" {
+		nonce, err := auth.RandomToken()
+		if err != nil {
+			logging.Errorf("failed to generate Monzo OAuth state: %s", err)
+			m.redirectToWebApp(w, r, "state_generation_failed")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookie,
+			Value:    nonce,
+			Path:     "/api/auth/monzo",
+			MaxAge:   int(stateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(m.serviceRedirectURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		authQuery := url.Values{}
+		authQuery.Set("client_id", m.currentAuth.ClientID)
+		authQuery.Set("redirect_uri", m.serviceRedirectURL)
+		authQuery.Set("response_type", "code")
+		authQuery.Set("state", m.stateSigner.Sign(auth.PurposeOAuthState, nonce, stateTTL))
+		authURL := m.authURL + "?" + authQuery.Encode()
 
 		http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 		return
 	}
 
+	// the state is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:   stateCookie,
+		Path:   "/api/auth/monzo",
+		MaxAge: -1,
+	})
+
+	if err := m.verifyState(r); err != nil {
+		logging.Warnf("rejected Monzo OAuth callback from %s: %s", r.RemoteAddr, err)
+		m.redirectToWebApp(w, r, "invalid_state")
+		return
+	}
+
+	// the user declined access
+	if authErr := q.Get("error"); authErr != "" {
+		logging.Errorf("Monzo OAuth failed: %s", authErr)
+		m.redirectToWebApp(w, r, authErr)
+		return
+	}
+
 	// second step of oauth - monzo sent a temporary access code - request an access token from monzo
-	if err := m.fetchAccessToken(code, accessCodeInitial); err != nil {
-		log.Printf("failed to fetch access token: %s", err)
+	if err := m.fetchAccessToken(q.Get("code"), accessCodeInitial); err != nil {
+		logging.Errorf("failed to fetch access token: %s", err)
+		m.redirectToWebApp(w, r, "token_exchange_failed")
+		return
+	}
+
+	m.redirectToWebApp(w, r, "")
+}
+
+// verifyState verifies that the callback's state was signed by the service, has not expired and was generated for the
+// requesting browser.
+func (m *Monzo) verifyState(r *http.Request) error {
+	nonce, err := m.stateSigner.Verify(auth.PurposeOAuthState, r.URL.Query().Get("state"))
+	if err != nil {
+		return fmt.Errorf("failed to verify state: %s", err)
 	}
 
-	http.Redirect(w, r, m.webAppRedirectURL, http.StatusFound)
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil {
+		return errors.New("no state cookie, the authentication may have been started from another browser")
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(nonce)) != 1 {
+		return errors.New("state does not match state cookie")
+	}
+	return nil
+}
+
+// redirectToWebApp redirects to the web app sources page, reporting the authentication error if set, or success.
+func (m *Monzo) redirectToWebApp(w http.ResponseWriter, r *http.Request, authErr string) {
+	q := url.Values{}
+	if authErr != "" {
+		q.Set("auth_error", authErr)
+	} else {
+		q.Set("auth", "success")
+	}
+	http.Redirect(w, r, m.webAppRedirectURL+"?"+q.Encode(), http.StatusFound)
 }
 
 const (
@@ -65,13 +162,13 @@ func (m *Monzo) fetchAccessToken(code string, requestType int) error {
 	}
 
 	// third step of oauth - exchange the temporary access code for an access token
-	req, err := http.NewRequest(http.MethodPost, "https://api.monzo.com/oauth2/token", strings.NewReader(form.Encode()))
+	req, err := http.NewRequest(http.MethodPost, m.apiURL+"/oauth2/token", strings.NewReader(form.Encode()))
 	if err != nil {
 		return fmt.Errorf("failed to create token request: %s", err)
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := httpClient.Do(req)
+	resp, err := m.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to perform token request: %s", err)
 	}
@@ -88,8 +185,10 @@ func (m *Monzo) fetchAccessToken(code string, requestType int) error {
 
 	var authCallback authAccessDetails
 	if err := json.Unmarshal(b, &authCallback); err != nil {
-		return fmt.Errorf("failed to JSON decode token response body: %s, %s", err, b)
+		return fmt.Errorf("failed to JSON decode token response body: %s", err)
 	}
+	authCallback.ObtainedAt = time.Now().UTC()
+	m.redactAuth(authCallback)
 
 	// update auth details
 	m.authRefreshedChan <- authCallback
@@ -98,34 +197,14 @@ func (m *Monzo) fetchAccessToken(code string, requestType int) error {
 
 // isAuthenticated determines if the Monzo source client is fully authenticated (email & app approved).
 func (m *Monzo) isAuthenticated() (bool, error) {
-	req, err := http.NewRequest(http.MethodGet, "https://api.monzo.com/ping/whoami", nil)
-	if err != nil {
-		return false, fmt.Errorf("failed to create authenticated request: %s", err)
-	}
-	req.Header.Add("Authorization", "Bearer "+m.currentAuth.AccessToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("failed to perform authenticated request: %s", err)
-	}
-
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, fmt.Errorf("failed to read authenticated response body: %s", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("non-200 status for authenticated request: %s, body: %s", resp.Status, b)
-	}
-
 	var fields map[string]interface{}
-	if err := json.Unmarshal(b, &fields); err != nil {
-		return false, fmt.Errorf("failed to JSON decode authenticated response body: %s, %s", err, b)
+	if err := m.apiGet(context.Background(), "/ping/whoami", nil, &fields); err != nil {
+		return false, err
 	}
 
 	authenticated, ok := fields["authenticated"].(bool)
 	if !ok {
-		return false, fmt.Errorf("failed to extract authenticated field as bool: %s, %v", err, fields)
+		return false, fmt.Errorf("failed to extract authenticated field as bool: %v", fields)
 	}
 
 	return authenticated, nil
@@ -0,0 +1,103 @@
+package monzo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+// Measurements which snapshots of account balances and pots are written to.
+const (
+	balanceMeasurement = "monzo_balance"
+	potsMeasurement    = "monzo_pots"
+)
+
+type balanceResult struct {
+	Balance      int    `json:"balance"`
+	TotalBalance int    `json:"total_balance"`
+	SpendToday   int    `json:"spend_today"`
+	Currency     string `json:"currency"`
+}
+
+type potsResult struct {
+	Pots []pot `json:"pots"`
+}
+
+type pot struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Balance    int    `json:"balance"`
+	GoalAmount int    `json:"goal_amount"`
+	Currency   string `json:"currency"`
+	Deleted    bool   `json:"deleted"`
+}
+
+// collectSnapshots writes a snapshot of the account's balance and each of its pots at the provided time, returning the
+// number of records written.
+func (m *Monzo) collectSnapshots(ctx context.Context, account account, at time.Time) (int, error) {
+	q := url.Values{}
+	q.Set("account_id", account.ID)
+	var balance balanceResult
+	if err := m.apiGet(ctx, "/balance", q, &balance); err != nil {
+		return 0, fmt.Errorf("failed to get balance for account %s: %s", account.ID, err)
+	}
+
+	q = url.Values{}
+	q.Set("current_account_id", account.ID)
+	var pots potsResult
+	if err := m.apiGet(ctx, "/pots", q, &pots); err != nil {
+		return 0, fmt.Errorf("failed to get pots for account %s: %s", account.ID, err)
+	}
+
+	// spending today is negative, so store it as a positive amount like transaction amounts
+	spendToday := penceToPounds(-balance.SpendToday)
+	balanceRes := sources.Result{
+		Time: at,
+		Tags: accountTags(account),
+		Fields: map[string]interface{}{
+			"balance":       penceToPounds(balance.Balance),
+			"total_balance": penceToPounds(balance.TotalBalance),
+			"spend_today":   spendToday,
+			"currency":      balance.Currency,
+		},
+	}
+	if err := m.exporter.Write(balanceMeasurement, balanceRes); err != nil {
+		return 0, fmt.Errorf("failed to write balance for account %s: %s", account.ID, err)
+	}
+
+	potResults := make([]sources.Result, 0, len(pots.Pots))
+	for _, pot := range pots.Pots {
+		if pot.Deleted {
+			continue
+		}
+
+		res := sources.Result{
+			Time: at,
+			Tags: accountTags(account),
+			Fields: map[string]interface{}{
+				"balance":  penceToPounds(pot.Balance),
+				"currency": pot.Currency,
+			},
+		}
+		res.Tags["pot_id"] = pot.ID
+		res.Tags["pot_name"] = pot.Name
+		// pots without a goal have no goal field
+		if pot.GoalAmount > 0 {
+			res.Fields["goal"] = penceToPounds(pot.GoalAmount)
+		}
+		potResults = append(potResults, res)
+	}
+	if err := m.exporter.Write(potsMeasurement, potResults...); err != nil {
+		return 1, fmt.Errorf("failed to write pots for account %s: %s", account.ID, err)
+	}
+
+	return 1 + len(potResults), nil
+}
+
+// penceToPounds converts an amount in pence (1234) to pounds (12.34).
+func penceToPounds(amount int) float64 {
+	return float64(amount) / 100
+}
@@ -0,0 +1,531 @@
+// Package fake provides a stand-in Monzo API and auth server with generated sample data, for exercising the Monzo
+// source without a real bank account.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+)
+
+// Credentials accepted by the fake server.
+const (
+	ClientID     = "oauth2client_fake"
+	ClientSecret = "fake-client-secret"
+	authCode     = "fake-auth-code"
+)
+
+const (
+	// fullHistoryAccessPeriod is how long after authenticating that transactions of any age can be fetched
+	fullHistoryAccessPeriod = time.Minute * 5
+	// restrictedHistory is how far back transactions can be fetched once the full history access period has passed
+	restrictedHistory = time.Hour * 24 * 90
+)
+
+// Server is a fake Monzo server which serves both the API and the auth page. It supports the OAuth2 token exchange,
+// whoami, accounts, paginated transactions, balance, pots and webhook registration. As with Monzo, transactions older
+// than 90 days can only be fetched within 5 minutes of authenticating.
+type Server struct {
+	mux *http.ServeMux
+
+	mu           sync.Mutex
+	accounts     []Account
+	transactions map[string][]Transaction
+	pots         map[string][]Pot
+	webhooks     map[string][]Webhook
+	accessTokens map[string]bool
+	tokenSeq     int
+	// authenticatedAt is when an access code was last exchanged, which refreshing tokens doesn't reset
+	authenticatedAt time.Time
+}
+
+// Account is a fake Monzo account.
+type Account struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Type        string    `json:"type"`
+	Closed      bool      `json:"closed"`
+	Created     time.Time `json:"created"`
+}
+
+// Transaction is a fake Monzo transaction.
+type Transaction struct {
+	ID          string    `json:"id"`
+	AccountID   string    `json:"account_id"`
+	Amount      int       `json:"amount"`
+	Created     time.Time `json:"created"`
+	Currency    string    `json:"currency"`
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Notes       string    `json:"notes"`
+	Settled     string    `json:"settled"`
+	Merchant    *Merchant `json:"merchant"`
+}
+
+// Merchant is a fake Monzo merchant.
+type Merchant struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Address  struct {
+		City      string  `json:"city"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"address"`
+}
+
+// Pot is a fake Monzo pot.
+type Pot struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Balance    int    `json:"balance"`
+	GoalAmount int    `json:"goal_amount,omitempty"`
+	Currency   string `json:"currency"`
+	Deleted    bool   `json:"deleted"`
+}
+
+// Webhook is a registered webhook.
+type Webhook struct {
+	ID        string `json:"id"`
+	AccountID string `json:"account_id"`
+	URL       string `json:"url"`
+}
+
+// New initialises a fake Monzo server with a year of generated transactions for a personal and a joint account.
+func New() *Server {
+	s := &Server{
+		mux:          http.NewServeMux(),
+		transactions: make(map[string][]Transaction),
+		pots:         make(map[string][]Pot),
+		webhooks:     make(map[string][]Webhook),
+		accessTokens: make(map[string]bool),
+	}
+	s.generate(time.Now().UTC(), rand.New(rand.NewSource(1)))
+
+	s.mux.HandleFunc("/", s.authPageHandler)
+	s.mux.HandleFunc("/oauth2/token", s.tokenHandler)
+	s.mux.HandleFunc("/ping/whoami", s.authenticated(s.whoamiHandler))
+	s.mux.HandleFunc("/accounts", s.authenticated(s.accountsHandler))
+	s.mux.HandleFunc("/transactions", s.authenticated(s.transactionsHandler))
+	s.mux.HandleFunc("/transactions/", s.authenticated(s.transactionHandler))
+	s.mux.HandleFunc("/balance", s.authenticated(s.balanceHandler))
+	s.mux.HandleFunc("/pots", s.authenticated(s.potsHandler))
+	s.mux.HandleFunc("/webhooks", s.authenticated(s.webhooksHandler))
+	return s
+}
+
+// ServeHTTP serves fake Monzo API and auth requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// AddTransaction adds a transaction to an account, e.g. to simulate a new transaction arriving.
+func (s *Server) AddTransaction(t Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := append(s.transactions[t.AccountID], t)
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Created.Before(transactions[j].Created)
+	})
+	s.transactions[t.AccountID] = transactions
+}
+
+var (
+	merchants = []struct {
+		name, category, city string
+		lat, long            float64
+		minPence, maxPence   int
+	}{
+		{"Pret A Manger", "eating_out", "London", 51.5155, -0.1410, 300, 900},
+		{"Dishoom", "eating_out", "London", 51.5124, -0.1269, 2000, 6000},
+		{"Tesco", "groceries", "London", 51.5033, -0.1195, 500, 8000},
+		{"Sainsbury's", "groceries", "Manchester", 53.4808, -2.2426, 500, 8000},
+		{"Transport for London", "transport", "London", 51.4952, -0.1441, 150, 800},
+		{"Trainline", "transport", "Edinburgh", 55.9533, -3.1883, 1500, 12000},
+		{"Odeon", "entertainment", "Bristol", 51.4545, -2.5879, 800, 2500},
+		{"Spotify", "entertainment", "", 0, 0, 999, 999},
+		{"Octopus Energy", "bills", "", 0, 0, 6000, 12000},
+	}
+	notes = []string{"", "", "", "with friends", "work lunch", "birthday"}
+)
+
+// generate populates the server with accounts, transactions and pots for the year before now.
+func (s *Server) generate(now time.Time, random *rand.Rand) {
+	created := now.AddDate(-1, 0, 0)
+	s.accounts = []Account{
+		{ID: "acc_fake_personal", Description: "user_fake", Type: "uk_retail", Created: created},
+		{ID: "acc_fake_joint", Description: "joint_fake", Type: "uk_retail_joint", Created: created},
+	}
+
+	var seq int
+	for _, account := range s.accounts {
+		var transactions []Transaction
+		for day := created; day.Before(now); day = day.AddDate(0, 0, 1) {
+			// monthly salary into the personal account
+			if day.Day() == 25 && account.Type == "uk_retail" {
+				seq++
+				transactions = append(transactions, Transaction{
+					ID:          fmt.Sprintf("tx_fake_%06d", seq),
+					AccountID:   account.ID,
+					Amount:      250000,
+					Created:     day.Add(time.Hour * 9),
+					Currency:    "GBP",
+					Description: "SALARY",
+					Category:    "income",
+					Settled:     day.Add(time.Hour * 9).Format(time.RFC3339),
+				})
+			}
+
+			for i := random.Intn(5); i > 0; i-- {
+				m := merchants[random.Intn(len(merchants))]
+				merchant := &Merchant{
+					ID:       "merch_fake_" + strings.ToLower(strings.Fields(m.name)[0]),
+					Name:     m.name,
+					Category: m.category,
+				}
+				merchant.Address.City = m.city
+				merchant.Address.Latitude = m.lat
+				merchant.Address.Longitude = m.long
+
+				txCreated := day.Add(time.Duration(random.Int63n(int64(time.Hour * 24))))
+				if txCreated.After(now) {
+					continue
+				}
+				settled := ""
+				// transactions settle after a day
+				if now.Sub(txCreated) > time.Hour*24 {
+					settled = txCreated.Add(time.Hour * 24).Format(time.RFC3339)
+				}
+
+				seq++
+				transactions = append(transactions, Transaction{
+					ID:          fmt.Sprintf("tx_fake_%06d", seq),
+					AccountID:   account.ID,
+					Amount:      -(m.minPence + random.Intn(m.maxPence-m.minPence+1)),
+					Created:     txCreated,
+					Currency:    "GBP",
+					Description: strings.ToUpper(m.name),
+					Category:    m.category,
+					Notes:       notes[random.Intn(len(notes))],
+					Settled:     settled,
+					Merchant:    merchant,
+				})
+			}
+		}
+
+		sort.SliceStable(transactions, func(i, j int) bool {
+			return transactions[i].Created.Before(transactions[j].Created)
+		})
+		s.transactions[account.ID] = transactions
+	}
+
+	s.pots["acc_fake_personal"] = []Pot{
+		{ID: "pot_fake_savings", Name: "Savings", Balance: 420000, GoalAmount: 1000000, Currency: "GBP"},
+		{ID: "pot_fake_holiday", Name: "Holiday", Balance: 65000, Currency: "GBP"},
+		{ID: "pot_fake_old", Name: "Old Pot", Currency: "GBP", Deleted: true},
+	}
+	s.pots["acc_fake_joint"] = []Pot{
+		{ID: "pot_fake_bills", Name: "Bills", Balance: 30000, Currency: "GBP"},
+	}
+}
+
+// authPageHandler stands in for the Monzo auth page, immediately approving the request and redirecting back with an
+// access code.
+func (s *Server) authPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	redirectURL, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != ClientID || q.Get("response_type") != "code" {
+		writeError(w, http.StatusBadRequest, "bad_request.invalid_auth_request")
+		return
+	}
+
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("code", authCode)
+	if state := q.Get("state"); state != "" {
+		redirectQuery.Set("state", state)
+	}
+	redirectURL.RawQuery = redirectQuery.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.PostFormValue("client_id") != ClientID || r.PostFormValue("client_secret") != ClientSecret {
+		writeError(w, http.StatusUnauthorized, "unauthorized.bad_client")
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		if r.PostFormValue("code") != authCode {
+			writeError(w, http.StatusUnauthorized, "unauthorized.bad_authorization_code")
+			return
+		}
+		s.mu.Lock()
+		s.authenticatedAt = time.Now()
+		s.mu.Unlock()
+	case "refresh_token":
+		if !strings.HasPrefix(r.PostFormValue("refresh_token"), "fake-refresh-token") {
+			writeError(w, http.StatusUnauthorized, "unauthorized.bad_refresh_token")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request.unsupported_grant_type")
+		return
+	}
+
+	s.mu.Lock()
+	s.tokenSeq++
+	accessToken := "fake-access-token-" + strconv.Itoa(s.tokenSeq)
+	s.accessTokens[accessToken] = true
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":  accessToken,
+		"client_id":     ClientID,
+		"expires_in":    108000,
+		"refresh_token": "fake-refresh-token-" + strconv.Itoa(s.tokenSeq),
+		"token_type":    "Bearer",
+		"user_id":       "user_fake",
+	})
+}
+
+// authenticated only serves requests with an access token issued by the server.
+func (s *Server) authenticated(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.mu.Lock()
+		ok := s.accessTokens[token]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "unauthorized.bad_access_token")
+			return
+		}
+		f(w, r)
+	}
+}
+
+// ExpireFullHistoryAccess ends the period after authenticating in which transactions older than 90 days can be
+// fetched, as if 5 minutes had passed.
+func (s *Server) ExpireFullHistoryAccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticatedAt = time.Time{}
+}
+
+func (s *Server) whoamiHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"authenticated": true,
+		"client_id":     ClientID,
+		"user_id":       "user_fake",
+	})
+}
+
+func (s *Server) accountsHandler(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{
+		"accounts": s.accounts,
+	})
+}
+
+// transactionsHandler lists an account's transactions in ascending order, supporting pagination via the limit query
+// and a since query of either a timestamp or the ID of the last transaction of the previous page.
+func (s *Server) transactionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := 30
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 100 {
+			writeError(w, http.StatusBadRequest, "bad_request.invalid_limit")
+			return
+		}
+	}
+	before := time.Now().UTC().Add(time.Hour)
+	if b := q.Get("before"); b != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, b); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request.invalid_before")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, ok := s.transactions[q.Get("account_id")]
+	if !ok {
+		writeError(w, http.StatusForbidden, "forbidden.insufficient_permissions")
+		return
+	}
+
+	start := 0
+	if since := q.Get("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err == nil {
+			start = sort.Search(len(all), func(i int) bool {
+				return !all[i].Created.Before(sinceTime)
+			})
+		} else {
+			// an unknown transaction ID returns no transactions
+			start = len(all)
+			for i, t := range all {
+				if t.ID == since {
+					start = i + 1
+					sinceTime = t.Created
+					break
+				}
+			}
+		}
+
+		restricted := time.Since(s.authenticatedAt) > fullHistoryAccessPeriod
+		if restricted && !sinceTime.IsZero() && time.Since(sinceTime) > restrictedHistory {
+			writeError(w, http.StatusForbidden, "forbidden.verification_required")
+			return
+		}
+	}
+
+	transactions := []Transaction{}
+	for _, t := range all[start:] {
+		if !t.Created.Before(before) || len(transactions) == limit {
+			break
+		}
+		transactions = append(transactions, t)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"transactions": transactions,
+	})
+}
+
+func (s *Server) transactionHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/transactions/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, transactions := range s.transactions {
+		for _, t := range transactions {
+			if t.ID == id {
+				writeJSON(w, map[string]interface{}{
+					"transaction": t,
+				})
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found.transaction")
+}
+
+func (s *Server) balanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions, ok := s.transactions[r.URL.Query().Get("account_id")]
+	if !ok {
+		writeError(w, http.StatusForbidden, "forbidden.insufficient_permissions")
+		return
+	}
+
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+	var balance, spendToday int
+	for _, t := range transactions {
+		balance += t.Amount
+		if t.Amount < 0 && !t.Created.Before(today) {
+			spendToday += t.Amount
+		}
+	}
+	totalBalance := balance
+	for _, pot := range s.pots[r.URL.Query().Get("account_id")] {
+		totalBalance += pot.Balance
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"balance":       balance,
+		"total_balance": totalBalance,
+		"currency":      "GBP",
+		"spend_today":   spendToday,
+	})
+}
+
+func (s *Server) potsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pots := s.pots[r.URL.Query().Get("current_account_id")]
+	if pots == nil {
+		pots = []Pot{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"pots": pots,
+	})
+}
+
+func (s *Server) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		webhooks := s.webhooks[r.URL.Query().Get("account_id")]
+		if webhooks == nil {
+			webhooks = []Webhook{}
+		}
+		writeJSON(w, map[string]interface{}{
+			"webhooks": webhooks,
+		})
+
+	case http.MethodPost:
+		webhook := Webhook{
+			ID:        "webhook_fake_" + strconv.Itoa(len(s.webhooks)+1),
+			AccountID: r.PostFormValue("account_id"),
+			URL:       r.PostFormValue("url"),
+		}
+		s.webhooks[webhook.AccountID] = append(s.webhooks[webhook.AccountID], webhook)
+		writeJSON(w, map[string]interface{}{
+			"webhook": webhook,
+		})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logging.Errorf("fake Monzo failed to JSON encode response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	b, _ := json.Marshal(map[string]string{
+		"code":    code,
+		"message": "fake Monzo error: " + code,
+	})
+	w.Write(b)
+}
@@ -0,0 +1,8 @@
+package monzo
+
+import (
+	"github.com/jemgunay/life-metrics/metrics"
+)
+
+var tokenRefreshes = metrics.NewCounter("life_metrics_token_refreshes_total",
+	"Source OAuth access token refreshes, by source, user and result.", "source", "user", "result")
@@ -1,267 +1,448 @@
 package monzo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jemgunay/life-metrics/auth"
 	"github.com/jemgunay/life-metrics/config"
+	"github.com/jemgunay/life-metrics/logging"
 	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+	"github.com/jemgunay/life-metrics/tokens"
+	"github.com/jemgunay/life-metrics/users"
 )
 
-var httpClient = &http.Client{
-	Timeout: time.Second * 10,
-}
-
 // Monzo represents the Monzo collection source.
 type Monzo struct {
+	// user is the ID of the user that the source collects for
+	user               string
+	exporter           sources.Exporter
+	httpClient         *http.Client
+	apiURL             string
+	authURL            string
 	currentAuth        authAccessDetails
 	clientSecret       string
 	serviceRedirectURL string
 	webAppRedirectURL  string
+	stateSigner        *auth.Signer
 	authRefreshedChan  chan authAccessDetails
-	collectionChan     chan sources.Period
+	collectionChan     chan collectionRequest
+	webhookChan        chan webhookRequest
+	// categories is the set of transaction categories to store - all are stored if empty
+	categories map[string]bool
+	// excludedCategories is the set of transaction categories which are never stored
+	excludedCategories map[string]bool
+	// accounts is the set of account IDs or types to collect - all accounts are collected if empty
+	accounts map[string]bool
+	// checkpoints records where each account's collection reached so that a failed collection can be resumed
+	checkpoints map[string]checkpoint
+	// webhookSecret verifies webhook requests - webhooks are disabled if empty
+	webhookSecret     string
+	serviceWebhookURL string
+	// seenTransactions is the time each recent webhook transaction was received, to deduplicate redeliveries
+	seenTransactions map[string]time.Time
+	// store is the user's view of the store that the exporter writes to, which is read to replace transactions
+	// stored with outdated tags
+	store storage.Store
+	// lastWebhookTransaction is the created time of the latest transaction received by webhook
+	lastWebhookTransaction time.Time
+	// collectedUntil is the latest end of a complete collection's period
+	collectedUntil time.Time
+
+	progressMu sync.Mutex
+	progress   *progress
+}
+
+// collectionRequest is a request for the collection goroutine to collect a period, replying with the outcome on done.
+type collectionRequest struct {
+	ctx    context.Context
+	period sources.Period
+	done   chan collectionResult
+}
+
+type collectionResult struct {
+	records int
+	err     error
 }
 
-// New initialises the Monzo source and manages auth token refreshing.
-func New(conf config.Config, exporter sources.Exporter) *Monzo {
+// New initialises the user's Monzo source and manages auth token refreshing. Auth tokens are loaded from and saved to
+// the token store so that authentication survives restarts, and OAuth state values are signed with the signer. store
+// is the user's view of the store which the exporter writes to.
+func New(conf config.Config, user users.User, exporter sources.Exporter, store storage.Store, tokenStore tokens.Store,
+	signer *auth.Signer) *Monzo {
+
+	// the user may have their own OAuth client
+	if user.Monzo.ClientID != "" {
+		conf.Monzo.ClientID = user.Monzo.ClientID
+		conf.Monzo.ClientSecret = user.Monzo.ClientSecret
+	}
+
+	httpClient := conf.Monzo.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: time.Second * 10,
+		}
+	}
+
 	m := &Monzo{
+		user:              user.ID,
+		exporter:          exporter,
+		store:             store,
+		httpClient:        httpClient,
+		apiURL:            strings.TrimSuffix(conf.Monzo.APIURL, "/"),
+		authURL:           strings.TrimSuffix(conf.Monzo.AuthURL, "/"),
 		authRefreshedChan: make(chan authAccessDetails, 1),
-		collectionChan:    make(chan sources.Period),
+		collectionChan:    make(chan collectionRequest),
+		webhookChan:       make(chan webhookRequest),
 		currentAuth: authAccessDetails{
 			ClientID: conf.Monzo.ClientID,
 		},
 		clientSecret:       conf.Monzo.ClientSecret,
 		serviceRedirectURL: conf.ServiceHost + "/api/auth/monzo",
 		webAppRedirectURL:  conf.WebAppHost + "/sources",
+		stateSigner:        signer,
+		categories:         toSet(conf.Monzo.Categories),
+		excludedCategories: toSet(conf.Monzo.ExcludedCategories),
+		accounts:           toSet(conf.Monzo.Accounts),
+		checkpoints:        make(map[string]checkpoint),
+		webhookSecret:      conf.Monzo.WebhookSecret,
+		serviceWebhookURL:  conf.ServiceHost + "/api/webhook/monzo",
+		seenTransactions:   make(map[string]time.Time),
+	}
+
+	// restore the auth tokens from before the last restart, refreshing them immediately if they have expired - there is
+	// nothing to refresh until authenticating if there are no tokens
+	var refreshTimer *time.Timer
+	if err := m.loadAuth(tokenStore); err != nil {
+		logging.Errorf("failed to load Monzo auth tokens: %s", err)
+	} else if m.currentAuth.RefreshToken != "" {
+		refreshTimer = time.NewTimer(m.currentAuth.refreshIn())
+		logging.Infof("Monzo auth tokens loaded - next authentication in %s", m.currentAuth.refreshIn())
 	}
 
-	// start polling for oauth initial, oauth refresh and collection requests
-	refreshTimer := time.NewTimer(time.Hour)
+	// start polling for oauth initial, oauth refresh, collection and webhook requests
 	go func() {
+		if m.currentAuth.AccessToken != "" {
+			m.ensureWebhooks()
+		}
+
+		refreshBackoff := minRefreshBackoff
 		for {
+			// receiving from a nil channel blocks, so no refresh is attempted while there is no timer
+			var refreshChan <-chan time.Time
+			if refreshTimer != nil {
+				refreshChan = refreshTimer.C
+			}
+
 			select {
-			case <-refreshTimer.C:
-				log.Print("starting Monzo authentication refresh")
-				m.fetchAccessToken(m.currentAuth.RefreshToken, accessCodeRefresh)
+			case <-refreshChan:
+				refreshTimer = nil
+				logging.Infof("starting Monzo authentication refresh")
+				if err := m.fetchAccessToken(m.currentAuth.RefreshToken, accessCodeRefresh); err != nil {
+					tokenRefreshes.Inc(m.Name(), m.user, "failure")
+
+					// retry until the access token expires, after which authenticating again is required
+					untilExpiry := time.Until(m.currentAuth.expiry())
+					if untilExpiry <= 0 {
+						logging.Errorf("failed to refresh Monzo access token, which has expired - oauth setup "+
+							"required: %s", err)
+						continue
+					}
+					retryIn := refreshBackoff
+					if retryIn > untilExpiry {
+						retryIn = untilExpiry
+					}
+					logging.Errorf("failed to refresh Monzo access token, retrying in %s: %s", retryIn, err)
+					refreshTimer = time.NewTimer(retryIn)
+					refreshBackoff *= 2
+					if refreshBackoff > maxRefreshBackoff {
+						refreshBackoff = maxRefreshBackoff
+					}
+				} else {
+					tokenRefreshes.Inc(m.Name(), m.user, "success")
+				}
 
 			case m.currentAuth = <-m.authRefreshedChan:
 				// reset auth refresh timer
-				refreshTimer.Stop()
-				timeToRefresh := (time.Second * time.Duration(m.currentAuth.ExpiresIn)) - time.Minute*5
+				if refreshTimer != nil {
+					refreshTimer.Stop()
+				}
+				refreshBackoff = minRefreshBackoff
+				timeToRefresh := m.currentAuth.refreshIn()
 				refreshTimer = time.NewTimer(timeToRefresh)
-				log.Printf("Monzo authenticated - next authentication in %s", timeToRefresh)
+				logging.Infof("Monzo authenticated - next authentication in %s", timeToRefresh)
 
-			case period := <-m.collectionChan:
-				results, err := m.performCollection(period)
-				if err != nil {
-					log.Printf("failed to perform collection for Monzo: %s", err)
+				if err := m.saveAuth(tokenStore); err != nil {
+					logging.Errorf("failed to save Monzo auth tokens: %s", err)
+				}
+				m.ensureWebhooks()
+
+			case req := <-m.collectionChan:
+				// the collection may have been cancelled while waiting for an auth refresh to complete
+				if err := req.ctx.Err(); err != nil {
+					req.done <- collectionResult{err: err}
 					continue
 				}
 
-				// write collected source data to influx
-				if err := exporter.Write(m.Name(), results...); err != nil {
-					log.Printf("writing data to influx failed for Monzo: %s", err)
+				records, err := m.performCollection(req.ctx, req.period)
+				if err != nil {
+					err = fmt.Errorf("failed to perform collection: %s", err)
 				}
+				req.done <- collectionResult{records: records, err: err}
+
+			case req := <-m.webhookChan:
+				req.done <- m.receiveTransaction(req.ctx, req.accountID, req.transactionID)
 			}
 		}
 	}()
 	return m
 }
 
+// ensureWebhooks registers the webhook for each collected account if webhooks are enabled.
+func (m *Monzo) ensureWebhooks() {
+	if m.webhookSecret == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := m.registerWebhooks(ctx); err != nil {
+		logging.Errorf("failed to register Monzo webhooks: %s", err)
+	}
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// loadAuth restores the current auth details from the token store.
+func (m *Monzo) loadAuth(tokenStore tokens.Store) error {
+	b, err := tokenStore.Load(m.Name())
+	if errors.Is(err, tokens.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var auth authAccessDetails
+	if err := json.Unmarshal(b, &auth); err != nil {
+		return fmt.Errorf("failed to JSON decode auth tokens: %s", err)
+	}
+	// the client ID is always taken from the config in case it has changed
+	auth.ClientID = m.currentAuth.ClientID
+	m.currentAuth = auth
+	m.redactAuth(auth)
+	return nil
+}
+
+// redactAuth registers the auth tokens to be redacted from logs in place of the tokens they replace.
+func (m *Monzo) redactAuth(auth authAccessDetails) {
+	logging.SetSecret("monzo/"+m.user+"/access_token", auth.AccessToken)
+	logging.SetSecret("monzo/"+m.user+"/refresh_token", auth.RefreshToken)
+}
+
+// saveAuth persists the current auth details to the token store.
+func (m *Monzo) saveAuth(tokenStore tokens.Store) error {
+	b, err := json.Marshal(m.currentAuth)
+	if err != nil {
+		return fmt.Errorf("failed to JSON encode auth tokens: %s", err)
+	}
+	return tokenStore.Save(m.Name(), b)
+}
+
 // Name returns the source name.
 func (m *Monzo) Name() string {
 	return "monzo"
 }
 
-// Collect enqueues a Monzo collection request.
-func (m *Monzo) Collect(period sources.Period) {
+// Collect performs a Monzo collection, waiting for any in progress auth refresh to complete first.
+func (m *Monzo) Collect(ctx context.Context, period sources.Period) (int, error) {
+	req := collectionRequest{
+		ctx:    ctx,
+		period: period,
+		done:   make(chan collectionResult, 1),
+	}
+
 	select {
-	case m.collectionChan <- period:
-	default:
-		log.Print("collection failed for Monzo as collection queue is full")
+	case m.collectionChan <- req:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case res := <-req.done:
+		return res.records, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
 }
 
-func (m *Monzo) performCollection(period sources.Period) ([]sources.Result, error) {
+func (m *Monzo) performCollection(ctx context.Context, period sources.Period) (int, error) {
 	if m.currentAuth.AccessToken == "" {
-		return nil, errors.New("access token not set - oauth setup required")
+		return 0, errors.New("access token not set - oauth setup required")
 	}
 
-	account, err := m.getAccount()
+	accounts, err := m.getAccounts(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get account: %s", err)
+		return 0, fmt.Errorf("failed to get accounts: %s", err)
 	}
 
-	// get transactions for account
-	transactions, err := m.getTransactions(account.ID, period.Start, period.End)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get transactions list: %s", err)
+	if m.webhookSecret != "" {
+		period.Start = m.webhookCollectionStart(period)
 	}
 
-	var results []sources.Result
-	for _, transaction := range transactions.Transactions {
-		// process eating out/take away data
-		if transaction.Category == "eating_out" {
-			createdTime, err := time.Parse(time.RFC3339, transaction.CreatedTime)
-			if err != nil {
-				log.Printf("failed to parse Monzo created time for %s: %s", transaction.CreatedTime, err)
-				continue
+	// collect the remaining accounts if one fails, and fail the collection once they are complete
+	var records int
+	var errs []string
+	snapshotTime := time.Now().UTC()
+	for _, account := range accounts {
+		accountRecords, err := m.collectTransactions(ctx, account, period, records)
+		records += accountRecords
+		if err != nil {
+			if ctx.Err() != nil {
+				return records, err
 			}
+			errs = append(errs, err.Error())
+		}
 
-			// convert price from pence (1234) to pounds (12.34)
-			amountInPounds := math.Abs(float64(transaction.Amount)) / 100
-
-			results = append(results, sources.Result{
-				Time: createdTime,
-				Tags: map[string]string{
-					"category":        transaction.Category,
-					"restaurant_name": transaction.Merchant.Name,
-					"restaurant_city": transaction.Merchant.Address.City,
-				},
-				Fields: map[string]interface{}{
-					"price":                amountInPounds,
-					"currency":             transaction.Currency,
-					"restaurant_latitude":  transaction.Merchant.Address.Latitude,
-					"restaurant_longitude": transaction.Merchant.Address.Longitude,
-				},
-			})
+		snapshotRecords, err := m.collectSnapshots(ctx, account, snapshotTime)
+		records += snapshotRecords
+		if err != nil {
+			if ctx.Err() != nil {
+				return records, err
+			}
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		return records, errors.New(strings.Join(errs, "; "))
+	}
 
-	return results, nil
-}
-
-type accountsResult struct {
-	Accounts []account `json:"accounts"`
-}
-
-type account struct {
-	ID          string `json:"id"`
-	Description string `json:"description"`
+	m.checkpoints = make(map[string]checkpoint)
+	if period.End.After(m.collectedUntil) {
+		m.collectedUntil = period.End
+	}
+	logging.Infof("Monzo collection complete: %d records collected from %d accounts", records, len(accounts))
+	m.setProgress(progress{PeriodStart: period.Start, PeriodEnd: period.End, CollectedUntil: period.End,
+		Records: records, Complete: true})
+	return records, nil
 }
 
-func (m *Monzo) getAccount() (account, error) {
-	req, err := http.NewRequest(http.MethodGet, "https://api.monzo.com/accounts", nil)
+// apiGet performs an authenticated GET request to the Monzo API and JSON decodes the response body into v.
+func (m *Monzo) apiGet(ctx context.Context, path string, q url.Values, v interface{}) error {
+	reqURL := m.apiURL + path
+	if len(q) > 0 {
+		reqURL += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
-		return account{}, fmt.Errorf("failed to create accounts request: %s", err)
+		return fmt.Errorf("failed to create %s request: %s", path, err)
 	}
 	req.Header.Add("Authorization", "Bearer "+m.currentAuth.AccessToken)
 
-	resp, err := httpClient.Do(req)
+	resp, err := m.httpClient.Do(req)
 	if err != nil {
-		return account{}, fmt.Errorf("failed to perform accounts request: %s", err)
+		return fmt.Errorf("failed to perform %s request: %s", path, err)
 	}
+	defer resp.Body.Close()
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return account{}, fmt.Errorf("failed to read accounts response body: %s", err)
+		return fmt.Errorf("failed to read %s response body: %s", path, err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return account{}, fmt.Errorf("non-200 status for accounts request: %s, body: %s", resp.Status, b)
-	}
-
-	var accounts accountsResult
-	if err := json.Unmarshal(b, &accounts); err != nil {
-		return account{}, fmt.Errorf("failed to JSON decode accounts response body: %s, %s", err, b)
+		apiErr := apiError{path: path, status: resp.Status, statusCode: resp.StatusCode, body: b}
+		// the body is only used to identify the error if it is JSON
+		_ = json.Unmarshal(b, &apiErr)
+		return apiErr
 	}
 
-	if len(accounts.Accounts) == 0 {
-		return account{}, errors.New("no accounts found")
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to JSON decode %s response body: %s", path, err)
 	}
-
-	return accounts.Accounts[0], nil
+	return nil
 }
 
-type transactionsResult struct {
-	Transactions []transaction `json:"transactions"`
+// apiError is a non-200 response from the Monzo API.
+type apiError struct {
+	path       string
+	status     string
+	statusCode int
+	body       []byte
+	// Code identifies the error, e.g. forbidden.verification_required
+	Code string `json:"code"`
 }
 
-type transaction struct {
-	AccountBalance int      `json:"account_balance"`
-	Amount         int      `json:"amount"`
-	CreatedTime    string   `json:"created"`
-	Currency       string   `json:"currency"`
-	Description    string   `json:"description"`
-	ID             string   `json:"id"`
-	Merchant       merchant `json:"merchant"`
-	Notes          string   `json:"notes"`
-	IsLoad         bool     `json:"is_load"`
-	Settled        string   `json:"settled"`
-	Category       string   `json:"category"`
+func (e apiError) Error() string {
+	return fmt.Sprintf("non-200 status for %s request: %s, body: %s", e.path, e.status, e.body)
 }
 
-type merchant struct {
-	Address struct {
-		Address   string  `json:"address"`
-		City      string  `json:"city"`
-		Country   string  `json:"country"`
-		Latitude  float64 `json:"latitude"`
-		Longitude float64 `json:"longitude"`
-		Postcode  string  `json:"postcode"`
-		Region    string  `json:"region"`
-	} `json:"address"`
-	Created  string `json:"created"`
-	GroupID  string `json:"group_id"`
-	ID       string `json:"id"`
-	Logo     string `json:"logo"`
-	Emoji    string `json:"emoji"`
-	Name     string `json:"name"`
-	Category string `json:"category"`
+type accountsResult struct {
+	Accounts []account `json:"accounts"`
 }
 
-func (m *Monzo) getTransactions(accountID string, start, end time.Time) (transactionsResult, error) {
-	var transactions transactionsResult
-
-	q := url.Values{}
-	q.Set("account_id", accountID)
-	q.Set("since", start.Format(time.RFC3339))
-	q.Set("before", end.Format(time.RFC3339))
-	// enrich transaction with merchant data
-	q.Set("expand[]", "merchant")
-
-	req, err := http.NewRequest(http.MethodGet, "https://api.monzo.com/transactions?"+q.Encode(), nil)
-	if err != nil {
-		return transactions, fmt.Errorf("failed to create accounts request: %s", err)
-	}
-	req.Header.Add("Authorization", "Bearer "+m.currentAuth.AccessToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return transactions, fmt.Errorf("failed to create transactions request: %s", err)
-	}
+type account struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Type        string    `json:"type"`
+	Closed      bool      `json:"closed"`
+	Created     time.Time `json:"created"`
+}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return transactions, fmt.Errorf("failed to read transactions response body: %s", err)
+// getAccounts gets the accounts to collect, which are those with an ID or type in the configured set of accounts, or
+// all accounts if the set is empty.
+func (m *Monzo) getAccounts(ctx context.Context) ([]account, error) {
+	var accounts accountsResult
+	if err := m.apiGet(ctx, "/accounts", nil, &accounts); err != nil {
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return transactions, fmt.Errorf("non-200 status for transactions request: %s, body: %s", resp.Status, b)
+	var collected []account
+	for _, account := range accounts.Accounts {
+		if len(m.accounts) > 0 && !m.accounts[account.ID] && !m.accounts[account.Type] {
+			continue
+		}
+		collected = append(collected, account)
 	}
 
-	if err := json.Unmarshal(b, &transactions); err != nil {
-		return transactions, fmt.Errorf("failed to JSON decode transactions response body: %s, %s", err, b)
+	if len(collected) == 0 {
+		return nil, errors.New("no accounts found")
 	}
 
-	return transactions, nil
+	return collected, nil
 }
 
 // State returns the Monzo running state.
 func (m *Monzo) State() sources.StateSet {
 	authenticated, err := m.isAuthenticated()
 	if err != nil {
-		log.Printf("failed to fetch Monzo authentication state: %s", err)
+		logging.Errorf("failed to fetch Monzo authentication state: %s", err)
 	}
 
-	return map[string]interface{}{
+	state := map[string]interface{}{
 		"authenticated": authenticated,
 	}
+
+	m.progressMu.Lock()
+	if m.progress != nil {
+		state["progress"] = m.progress
+	}
+	m.progressMu.Unlock()
+
+	return state
 }
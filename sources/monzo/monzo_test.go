@@ -0,0 +1,477 @@
+package monzo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jemgunay/life-metrics/auth"
+	"github.com/jemgunay/life-metrics/config"
+	"github.com/jemgunay/life-metrics/disk"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/sources/monzo/fake"
+	"github.com/jemgunay/life-metrics/tokens"
+	"github.com/jemgunay/life-metrics/users"
+)
+
+// testEnv is a Monzo source which collects from a fake Monzo server into a disk store.
+type testEnv struct {
+	monzo   *Monzo
+	fake    *fake.Server
+	store   *disk.Store
+	api     *httptest.Server
+	service *httptest.Server
+	dir     string
+}
+
+// newTestEnv starts a fake Monzo server and a service serving the source's auth handler. modify can alter the config
+// before the source is created.
+func newTestEnv(t *testing.T, modify func(conf *config.Config)) *testEnv {
+	env := &testEnv{fake: fake.New()}
+	env.api = httptest.NewServer(env.fake)
+	env.service = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/monzo":
+			env.monzo.AuthenticateHandler(w, r)
+		case "/sources":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	var err error
+	env.dir, err = ioutil.TempDir("", "monzo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	env.store, err = disk.New(filepath.Join(env.dir, "life-metrics.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	conf := config.Default()
+	conf.ServiceHost = env.service.URL
+	conf.WebAppHost = env.service.URL
+	conf.Monzo.APIURL = env.api.URL
+	conf.Monzo.AuthURL = env.api.URL
+	conf.Monzo.ClientID = fake.ClientID
+	conf.Monzo.ClientSecret = fake.ClientSecret
+	if modify != nil {
+		modify(&conf)
+	}
+
+	signer, err := auth.NewSigner("secret")
+	if err != nil {
+		t.Fatalf("failed to create signer: %s", err)
+	}
+	env.monzo = New(conf, users.User{}, env.store, env.store, tokens.Nop{}, signer)
+	return env
+}
+
+func (e *testEnv) close() {
+	e.service.Close()
+	e.api.Close()
+	e.store.Close()
+	os.RemoveAll(e.dir)
+}
+
+// authenticate performs the OAuth flow in a browser-like client, returning the web app URL it finishes on.
+func (e *testEnv) authenticate(t *testing.T) *url.URL {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %s", err)
+	}
+	client := &http.Client{Jar: jar, Timeout: time.Second * 10}
+
+	resp, err := client.Get(e.service.URL + "/api/auth/monzo")
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	resp.Body.Close()
+	return resp.Request.URL
+}
+
+// collect collects the period, retrying while the access token from authenticating is yet to be applied.
+func (e *testEnv) collect(period sources.Period) (int, error) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		records, err := e.monzo.Collect(context.Background(), period)
+		if err == nil || !strings.Contains(err.Error(), "oauth setup required") || time.Now().After(deadline) {
+			return records, err
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func (e *testEnv) read(t *testing.T, measurement string, period sources.Period) []sources.Result {
+	results, err := e.store.ReadRange(measurement, period)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", measurement, err)
+	}
+	return results
+}
+
+// fakeTransactions pages through each of the fake server's accounts directly, returning the categories of the
+// transactions by ID.
+func (e *testEnv) fakeTransactions(t *testing.T) map[string]string {
+	form := url.Values{}
+	form.Set("client_id", fake.ClientID)
+	form.Set("client_secret", fake.ClientSecret)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", "fake-auth-code")
+	resp, err := http.PostForm(e.api.URL+"/oauth2/token", form)
+	if err != nil {
+		t.Fatalf("failed to get fake access token: %s", err)
+	}
+	var token authAccessDetails
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode fake access token: %s", err)
+	}
+
+	get := func(path string, q url.Values, v interface{}) {
+		req, err := http.NewRequest(http.MethodGet, e.api.URL+path+"?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to get %s: %s", path, err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode %s: %s", path, err)
+		}
+	}
+
+	var accounts accountsResult
+	get("/accounts", url.Values{}, &accounts)
+	categories := make(map[string]string)
+	for _, account := range accounts.Accounts {
+		var since string
+		for {
+			q := url.Values{}
+			q.Set("account_id", account.ID)
+			q.Set("limit", "100")
+			if since != "" {
+				q.Set("since", since)
+			}
+			var page transactionsResult
+			get("/transactions", q, &page)
+			for _, transaction := range page.Transactions {
+				categories[transaction.ID] = transaction.Category
+			}
+			if len(page.Transactions) < 100 {
+				break
+			}
+			since = page.Transactions[len(page.Transactions)-1].ID
+		}
+	}
+	return categories
+}
+
+// addBulkTransactions adds more transactions to the joint account on a single day than fit in a page.
+func (e *testEnv) addBulkTransactions(now time.Time) {
+	day := now.AddDate(0, 0, -10)
+	for i := 0; i < 150; i++ {
+		e.fake.AddTransaction(fake.Transaction{
+			ID:          fmt.Sprintf("tx_fake_bulk_%03d", i),
+			AccountID:   "acc_fake_joint",
+			Amount:      -100,
+			Created:     day.Add(time.Minute * time.Duration(i)),
+			Currency:    "GBP",
+			Description: "BULK",
+			Category:    "general",
+		})
+	}
+}
+
+// collectionPeriod covers all of the fake server's transactions.
+func collectionPeriod(now time.Time) sources.Period {
+	return sources.NewPeriod(now.AddDate(-1, 0, -1), now.Add(time.Minute))
+}
+
+func TestAuthenticate(t *testing.T) {
+	env := newTestEnv(t, nil)
+	defer env.close()
+
+	// the state is rejected without the cookie set for the browser which started the sequence
+	resp, err := http.Get(env.service.URL + "/api/auth/monzo?code=fake-auth-code&state=forged")
+	if err != nil {
+		t.Fatalf("failed to request callback: %s", err)
+	}
+	resp.Body.Close()
+	if got := resp.Request.URL.Query().Get("auth_error"); got != "invalid_state" {
+		t.Errorf("auth_error for a forged state = %q, want invalid_state", got)
+	}
+	if _, err := env.monzo.Collect(context.Background(), collectionPeriod(time.Now())); err == nil {
+		t.Fatal("expected collecting before authenticating to fail")
+	}
+
+	finalURL := env.authenticate(t)
+	if finalURL.Path != "/sources" || finalURL.Query().Get("auth") != "success" {
+		t.Fatalf("authentication finished on %s, want /sources?auth=success", finalURL)
+	}
+	if _, err := env.collect(sources.NewPeriod(time.Now().Add(-time.Hour), time.Now())); err != nil {
+		t.Errorf("failed to collect after authenticating: %s", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	env := newTestEnv(t, nil)
+	defer env.close()
+
+	now := time.Now().UTC()
+	env.addBulkTransactions(now)
+	env.authenticate(t)
+	want := env.fakeTransactions(t)
+
+	period := collectionPeriod(now)
+	records, err := env.collect(period)
+	if err != nil {
+		t.Fatalf("failed to collect: %s", err)
+	}
+
+	results := env.read(t, "monzo", period)
+	got := make(map[string]string, len(results))
+	accounts := make(map[string]int)
+	for _, result := range results {
+		id, _ := result.Fields[transactionIDField].(string)
+		if _, ok := got[id]; ok {
+			t.Errorf("transaction %s was stored more than once", id)
+		}
+		got[id] = result.Tags["category"]
+		accounts[result.Tags["account_id"]]++
+
+		if price, ok := result.Fields["price"].(float64); !ok || price <= 0 {
+			t.Errorf("transaction %s has price %v, want a positive amount", id, result.Fields["price"])
+		}
+		if direction := result.Tags["direction"]; direction != "debit" && direction != "credit" {
+			t.Errorf("transaction %s has direction %q", id, direction)
+		}
+		if _, ok := result.Fields["pending"].(bool); !ok {
+			t.Errorf("transaction %s has pending %v, want a bool", id, result.Fields["pending"])
+		}
+		// only eating_out merchants are also written to the restaurant tags
+		category := result.Tags["category"]
+		if category != "general" && category != "income" && result.Tags["merchant_name"] == "" {
+			t.Errorf("transaction %s has no merchant_name tag for its merchant", id)
+		}
+		if restaurant := result.Tags["restaurant_name"]; (category == "eating_out") != (restaurant != "") {
+			t.Errorf("transaction %s in category %s has restaurant_name %q", id, category, restaurant)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %d transactions, want the %d from the fake server", len(got), len(want))
+	}
+	if accounts["acc_fake_personal"] == 0 || accounts["acc_fake_joint"] < 150 {
+		t.Errorf("transactions stored per account = %v, want both accounts including the bulk transactions", accounts)
+	}
+	// each transaction plus a balance for each account and the three current pots
+	if wantRecords := len(want) + 2 + 3; records != wantRecords {
+		t.Errorf("collected %d records, want %d", records, wantRecords)
+	}
+
+	// collecting again replaces the stored transactions rather than duplicating them
+	if _, err := env.collect(period); err != nil {
+		t.Fatalf("failed to collect again: %s", err)
+	}
+	if results := env.read(t, "monzo", period); len(results) != len(want) {
+		t.Errorf("stored %d transactions after collecting again, want %d", len(results), len(want))
+	}
+}
+
+func TestCollectCategories(t *testing.T) {
+	env := newTestEnv(t, func(conf *config.Config) {
+		conf.Monzo.Categories = []string{"eating_out", "groceries", "income"}
+		conf.Monzo.ExcludedCategories = []string{"groceries"}
+	})
+	defer env.close()
+
+	now := time.Now().UTC()
+	env.authenticate(t)
+	var want int
+	for _, category := range env.fakeTransactions(t) {
+		if category == "eating_out" || category == "income" {
+			want++
+		}
+	}
+
+	period := collectionPeriod(now)
+	if _, err := env.collect(period); err != nil {
+		t.Fatalf("failed to collect: %s", err)
+	}
+
+	results := env.read(t, "monzo", period)
+	categories := make(map[string]bool)
+	for _, result := range results {
+		categories[result.Tags["category"]] = true
+	}
+	if wantCategories := map[string]bool{"eating_out": true, "income": true}; !reflect.DeepEqual(categories,
+		wantCategories) {
+		t.Errorf("stored categories = %v, want %v", categories, wantCategories)
+	}
+	if len(results) != want {
+		t.Errorf("stored %d transactions, want %d", len(results), want)
+	}
+}
+
+func TestCollectReplacesStaleTransactions(t *testing.T) {
+	env := newTestEnv(t, nil)
+	defer env.close()
+
+	now := time.Now().UTC()
+	created := now.AddDate(0, 0, -5).Truncate(time.Second)
+	env.fake.AddTransaction(fake.Transaction{
+		ID:          "tx_fake_recategorised",
+		AccountID:   "acc_fake_joint",
+		Amount:      -1250,
+		Created:     created,
+		Currency:    "GBP",
+		Description: "RECATEGORISED",
+		Category:    "groceries",
+	})
+
+	// a version stored with its old category and a legacy transaction ID tag, and another account's transaction at the
+	// same time
+	stored := []sources.Result{
+		{
+			Time: created,
+			Tags: map[string]string{
+				"account_id":     "acc_fake_joint",
+				"transaction_id": "tx_fake_recategorised",
+				"category":       "general",
+			},
+			Fields: map[string]interface{}{"price": 12.5},
+		},
+		{
+			Time:   created,
+			Tags:   map[string]string{"account_id": "acc_fake_other", "category": "transport"},
+			Fields: map[string]interface{}{"price": 3.0},
+		},
+	}
+	if err := env.store.Write("monzo", stored...); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	env.authenticate(t)
+	if _, err := env.collect(collectionPeriod(now)); err != nil {
+		t.Fatalf("failed to collect: %s", err)
+	}
+
+	results := env.read(t, "monzo", sources.NewPeriod(created, created.Add(time.Second)))
+	got := make(map[string]sources.Result)
+	for _, result := range results {
+		if result.Time.Equal(created) {
+			got[result.Tags["account_id"]] = result
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("stored transactions at %s = %+v, want one per account", created, results)
+	}
+	joint := got["acc_fake_joint"]
+	if _, ok := joint.Tags["transaction_id"]; ok || joint.Tags["category"] != "groceries" ||
+		joint.Fields[transactionIDField] != "tx_fake_recategorised" {
+		t.Errorf("recategorised transaction = %+v, want the groceries category and a transaction_id field", joint)
+	}
+	if other := got["acc_fake_other"]; other.Tags["category"] != "transport" {
+		t.Errorf("other account's transaction = %+v, want it rewritten unchanged", other)
+	}
+}
+
+func TestCollectSnapshots(t *testing.T) {
+	env := newTestEnv(t, nil)
+	defer env.close()
+
+	env.authenticate(t)
+	period := collectionPeriod(time.Now().UTC())
+	if _, err := env.collect(period); err != nil {
+		t.Fatalf("failed to collect: %s", err)
+	}
+
+	// the difference between the total balance and the balance is the sum of the account's pots
+	wantPots := map[string]int{"acc_fake_personal": 485000, "acc_fake_joint": 30000}
+	balances := env.read(t, balanceMeasurement, period)
+	if len(balances) != len(wantPots) {
+		t.Fatalf("stored %d balances, want %d", len(balances), len(wantPots))
+	}
+	for _, result := range balances {
+		accountID := result.Tags["account_id"]
+		balance, _ := result.Fields["balance"].(float64)
+		totalBalance, _ := result.Fields["total_balance"].(float64)
+		if pots := int(math.Round((totalBalance - balance) * 100)); pots != wantPots[accountID] {
+			t.Errorf("account %s's total balance exceeds its balance by %d pence, want %d", accountID, pots,
+				wantPots[accountID])
+		}
+		if spendToday, ok := result.Fields["spend_today"].(float64); !ok || spendToday < 0 {
+			t.Errorf("account %s's spend_today = %v, want a positive amount", accountID, result.Fields["spend_today"])
+		}
+		if result.Fields["currency"] != "GBP" {
+			t.Errorf("account %s's currency = %v, want GBP", accountID, result.Fields["currency"])
+		}
+	}
+
+	// deleted pots aren't stored and pots without a goal have no goal field
+	type potSnapshot struct {
+		accountID string
+		balance   interface{}
+		goal      interface{}
+	}
+	want := map[string]potSnapshot{
+		"pot_fake_savings": {accountID: "acc_fake_personal", balance: 4200.0, goal: 10000.0},
+		"pot_fake_holiday": {accountID: "acc_fake_personal", balance: 650.0},
+		"pot_fake_bills":   {accountID: "acc_fake_joint", balance: 300.0},
+	}
+	got := make(map[string]potSnapshot)
+	for _, result := range env.read(t, potsMeasurement, period) {
+		got[result.Tags["pot_id"]] = potSnapshot{
+			accountID: result.Tags["account_id"],
+			balance:   result.Fields["balance"],
+			goal:      result.Fields["goal"],
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pots = %+v, want %+v", got, want)
+	}
+}
+
+func TestWebhookCollectionStart(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	explicit := sources.NewPeriod(start, start.Add(time.Hour))
+	resumed := explicit
+	resumed.Resumed = true
+
+	// the first resumed collection since starting re-fetches the overlap, but explicit starts are left alone
+	m := &Monzo{}
+	if got := m.webhookCollectionStart(explicit); !got.Equal(start) {
+		t.Errorf("first explicit collection start = %s, want %s", got, start)
+	}
+	if got, want := m.webhookCollectionStart(resumed), start.Add(-webhookOverlap); !got.Equal(want) {
+		t.Errorf("first resumed collection start = %s, want %s", got, want)
+	}
+
+	// webhook transactions received since the last complete collection rewind resumed collections to its end
+	m.collectedUntil = start.Add(-time.Hour)
+	m.lastWebhookTransaction = start.Add(-time.Minute)
+	if got := m.webhookCollectionStart(explicit); !got.Equal(start) {
+		t.Errorf("explicit collection start = %s, want %s", got, start)
+	}
+	if got := m.webhookCollectionStart(resumed); !got.Equal(m.collectedUntil) {
+		t.Errorf("resumed collection start = %s, want %s", got, m.collectedUntil)
+	}
+}
@@ -0,0 +1,448 @@
+package monzo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/storage"
+)
+
+const (
+	// transactionsPageLimit is the maximum number of transactions requested per page
+	transactionsPageLimit = 100
+	// transactionsWindow is the time window transactions are fetched in, limiting how far each set of pages spans
+	transactionsWindow = time.Hour * 24 * 30
+	// pageAttempts is the number of times fetching a page is attempted before the collection fails
+	pageAttempts = 3
+	// transactionIDField is the field which identifies the transaction a result was created from. It isn't a tag, as
+	// that would create a series per transaction.
+	transactionIDField = "transaction_id"
+	// accessibleHistory is how far back transactions can be fetched more than 5 minutes after authenticating, which
+	// Monzo limits to 90 days - a day is deducted to allow for the time taken to collect
+	accessibleHistory = time.Hour * 24 * 89
+)
+
+// errHistoryRestricted indicates that transactions older than 90 days were requested more than 5 minutes after
+// authenticating, which Monzo doesn't allow.
+var errHistoryRestricted = errors.New("Monzo only allows transactions older than 90 days to be fetched within 5 " +
+	"minutes of authenticating")
+
+// checkpoint records the page an account's collection reached, so that a failed collection can be resumed.
+type checkpoint struct {
+	// collectedFrom is the time the account's transactions have been collected from up to the checkpoint
+	collectedFrom time.Time
+	windowStart   time.Time
+	sinceID       string
+}
+
+// progress reports the progress of the current or most recent collection.
+type progress struct {
+	PeriodStart    time.Time `json:"period_start"`
+	PeriodEnd      time.Time `json:"period_end"`
+	Account        string    `json:"account,omitempty"`
+	CollectedUntil time.Time `json:"collected_until"`
+	Records        int       `json:"records"`
+	Complete       bool      `json:"complete"`
+}
+
+// collectTransactions pages through the account's transactions for the period in time windows, writing each page as
+// it is fetched. The position reached is checkpointed so that if the collection fails, a subsequent collection which
+// covers the position resumes from the failed page rather than starting over. If the period includes transactions
+// older than Monzo allows to be fetched, the remainder of the period is collected and then the collection fails.
+// records is the number of records collected for previous accounts, for reporting progress.
+func (m *Monzo) collectTransactions(ctx context.Context, account account, period sources.Period,
+	records int) (int, error) {
+
+	// there are no transactions before the account was created, e.g. for a reset collection
+	windowStart := period.Start
+	if windowStart.Before(account.Created) {
+		windowStart = account.Created
+	}
+
+	// a checkpoint can be resumed from if the failed collection started no later than this one, as the account's
+	// transactions were collected up to it, even if this collection starts after the checkpoint, e.g. as another
+	// account's transactions have advanced the last collected timestamp
+	collectedFrom := windowStart
+	var sinceID string
+	if cp, ok := m.checkpoints[account.ID]; ok && !cp.collectedFrom.After(windowStart) &&
+		cp.windowStart.Before(period.End) {
+		logging.Infof("resuming Monzo collection for account %s from %s", account.ID, cp.windowStart)
+		collectedFrom, windowStart, sinceID = cp.collectedFrom, cp.windowStart, cp.sinceID
+	}
+
+	var accountRecords int
+	var restrictedErr error
+	for windowStart.Before(period.End) {
+		windowEnd := windowStart.Add(transactionsWindow)
+		if windowEnd.After(period.End) {
+			windowEnd = period.End
+		}
+
+		restricted := false
+		for {
+			m.checkpoints[account.ID] = checkpoint{
+				collectedFrom: collectedFrom,
+				windowStart:   windowStart,
+				sinceID:       sinceID,
+			}
+
+			transactions, err := m.getTransactionsPage(ctx, account.ID, windowStart, windowEnd, sinceID)
+			if errors.Is(err, errHistoryRestricted) && restrictedErr == nil {
+				restricted = true
+				break
+			}
+			if err != nil {
+				return accountRecords, fmt.Errorf("failed to collect transactions for account %s from %s, the next "+
+					"collection covering this time will resume from there: %s", account.ID,
+					windowStart.Format(time.RFC3339), err)
+			}
+			written, err := m.writeTransactions(account, transactions)
+			if err != nil {
+				return accountRecords, fmt.Errorf("failed to write transactions for account %s: %s", account.ID, err)
+			}
+			accountRecords += written
+
+			if len(transactions) < transactionsPageLimit {
+				break
+			}
+			// page from the last transaction, which the API excludes from the next page
+			sinceID = transactions[len(transactions)-1].ID
+		}
+
+		// skip to the transactions which can still be fetched, failing the collection once they are collected
+		if restricted {
+			accessibleStart := time.Now().Add(-accessibleHistory)
+			if !accessibleStart.After(windowStart) {
+				return accountRecords, fmt.Errorf("failed to collect transactions for account %s from %s: %s",
+					account.ID, windowStart.Format(time.RFC3339), errHistoryRestricted)
+			}
+			restrictedErr = fmt.Errorf("transactions for account %s from %s to %s were not collected, as %s - "+
+				"reauthenticate then collect this period again", account.ID, windowStart.Format(time.RFC3339),
+				accessibleStart.Format(time.RFC3339), errHistoryRestricted)
+			logging.Warnf("%s", restrictedErr)
+			collectedFrom, windowStart, sinceID = accessibleStart, accessibleStart, ""
+			continue
+		}
+
+		sinceID = ""
+		windowStart = windowEnd
+		m.setProgress(progress{PeriodStart: period.Start, PeriodEnd: period.End, Account: account.ID,
+			CollectedUntil: windowEnd, Records: records + accountRecords})
+	}
+
+	// the account is complete, so a resumed collection only needs to collect anything since the end of this period
+	m.checkpoints[account.ID] = checkpoint{
+		collectedFrom: collectedFrom,
+		windowStart:   period.End,
+	}
+	return accountRecords, restrictedErr
+}
+
+// writeTransactions writes the account's transactions in the stored categories, returning the number written.
+func (m *Monzo) writeTransactions(account account, transactions []transaction) (int, error) {
+	results := make([]sources.Result, 0, len(transactions))
+	for _, transaction := range transactions {
+		if !m.storesCategory(transaction.Category) {
+			continue
+		}
+
+		createdTime, err := time.Parse(time.RFC3339, transaction.CreatedTime)
+		if err != nil {
+			logging.Errorf("failed to parse Monzo created time for %s: %s", transaction.CreatedTime, err)
+			continue
+		}
+
+		results = append(results, newTransactionResult(createdTime, account, transaction))
+	}
+
+	// the transactions are still written if this fails, as storage may be unavailable while the outbox spools writes
+	if err := m.replaceStaleTransactions(results); err != nil {
+		logging.Warnf("failed to replace stale Monzo transactions: %s", err)
+	}
+
+	if err := m.exporter.Write(m.Name(), results...); err != nil {
+		return 0, fmt.Errorf("failed to write collected data: %s", err)
+	}
+	return len(results), nil
+}
+
+// replaceStaleTransactions deletes the stored versions of the transactions which have different tags to the results,
+// e.g. as the transaction was recategorised after it was first written, since the results would otherwise be stored
+// alongside them rather than overwriting them. Stored transactions are matched to results by time and account, as
+// the transaction ID isn't part of a point's identity. Points can only be deleted by time, so any other points stored
+// at the same time as a stale transaction are written again.
+func (m *Monzo) replaceStaleTransactions(results []sources.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tagsByKey := make(map[transactionKey][]map[string]string, len(results))
+	period := sources.NewPeriod(results[0].Time, results[0].Time)
+	for _, res := range results {
+		key := newTransactionKey(res)
+		tagsByKey[key] = append(tagsByKey[key], res.Tags)
+		if res.Time.Before(period.Start) {
+			period.Start = res.Time
+		}
+		if res.Time.After(period.End) {
+			period.End = res.Time
+		}
+	}
+	// influx ranges are to the second, so extend the exclusive end past the second of the last transaction
+	period.End = period.End.Add(time.Second)
+
+	stored, err := m.store.ReadRange(m.Name(), period)
+	if err != nil {
+		return fmt.Errorf("failed to read stored transactions: %s", err)
+	}
+
+	staleTimes := make(map[int64]time.Time)
+	for _, res := range stored {
+		tags, ok := tagsByKey[newTransactionKey(res)]
+		if ok && !anySameTags(res.Tags, tags) {
+			staleTimes[res.Time.UnixNano()] = res.Time
+		}
+	}
+	if len(staleTimes) == 0 {
+		return nil
+	}
+
+	var rewrites []sources.Result
+	for _, res := range stored {
+		if _, ok := staleTimes[res.Time.UnixNano()]; !ok {
+			continue
+		}
+		if _, ok := tagsByKey[newTransactionKey(res)]; !ok {
+			rewrites = append(rewrites, res)
+		}
+	}
+
+	for _, t := range staleTimes {
+		if err := m.store.Delete(m.Name(), sources.NewPeriod(t, t.Add(time.Nanosecond))); err != nil {
+			return fmt.Errorf("failed to delete stale transactions at %s: %s", t.Format(time.RFC3339Nano), err)
+		}
+	}
+	logging.Debugf("replacing %d stale Monzo transactions", len(staleTimes))
+
+	if err := m.exporter.Write(m.Name(), rewrites...); err != nil {
+		return fmt.Errorf("failed to rewrite transactions stored alongside stale transactions: %s", err)
+	}
+	return nil
+}
+
+// transactionKey identifies where a transaction is stored, regardless of its other tags.
+type transactionKey struct {
+	time      int64
+	accountID string
+}
+
+func newTransactionKey(res sources.Result) transactionKey {
+	return transactionKey{
+		time:      res.Time.UnixNano(),
+		accountID: res.Tags["account_id"],
+	}
+}
+
+// anySameTags determines if stored tags match any of the provided result tags.
+func anySameTags(stored map[string]string, tags []map[string]string) bool {
+	for _, t := range tags {
+		if sameTags(stored, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameTags determines if stored tags match a result's tags. The user tag added to stored results is ignored, as are
+// empty tags, which influx doesn't store.
+func sameTags(stored, tags map[string]string) bool {
+	var matched int
+	for k, v := range stored {
+		if k == storage.UserTag || v == "" {
+			continue
+		}
+		if tags[k] != v {
+			return false
+		}
+		matched++
+	}
+
+	for _, v := range tags {
+		if v != "" {
+			matched--
+		}
+	}
+	return matched == 0
+}
+
+func (m *Monzo) setProgress(p progress) {
+	m.progressMu.Lock()
+	defer m.progressMu.Unlock()
+	m.progress = &p
+}
+
+// storesCategory determines if transactions of the provided category should be stored, i.e. it is in the allow list
+// (if set) and is not in the deny list.
+func (m *Monzo) storesCategory(category string) bool {
+	if len(m.categories) > 0 && !m.categories[category] {
+		return false
+	}
+	return !m.excludedCategories[category]
+}
+
+// newTransactionResult converts an account's transaction into a result. Debits and credits are distinguished by the
+// direction tag and the price is always positive. The merchant of eating_out transactions, which were originally the
+// only ones collected, is also written to the restaurant tags and fields which existing queries use.
+func newTransactionResult(createdTime time.Time, account account, transaction transaction) sources.Result {
+	direction := "debit"
+	if transaction.Amount > 0 {
+		direction = "credit"
+	}
+
+	res := sources.Result{
+		Time: createdTime,
+		Tags: accountTags(account),
+		Fields: map[string]interface{}{
+			"price":       math.Abs(penceToPounds(transaction.Amount)),
+			"currency":    transaction.Currency,
+			"description": transaction.Description,
+			"notes":       transaction.Notes,
+		},
+	}
+
+	res.Fields[transactionIDField] = transaction.ID
+	res.Tags["category"] = transaction.Category
+	res.Tags["direction"] = direction
+
+	// pending transactions have no settled time
+	res.Fields["pending"] = transaction.Settled == ""
+	if transaction.Settled != "" {
+		res.Fields["settled"] = transaction.Settled
+	}
+
+	// transactions such as transfers have no merchant
+	if transaction.Merchant.ID == "" {
+		return res
+	}
+	prefixes := []string{"merchant"}
+	if transaction.Category == "eating_out" {
+		prefixes = append(prefixes, "restaurant")
+	}
+	for _, prefix := range prefixes {
+		res.Tags[prefix+"_name"] = transaction.Merchant.Name
+		if transaction.Merchant.Address.City != "" {
+			res.Tags[prefix+"_city"] = transaction.Merchant.Address.City
+		}
+		res.Fields[prefix+"_latitude"] = transaction.Merchant.Address.Latitude
+		res.Fields[prefix+"_longitude"] = transaction.Merchant.Address.Longitude
+	}
+
+	return res
+}
+
+// accountTags returns the tags which identify the account a result belongs to.
+func accountTags(account account) map[string]string {
+	return map[string]string{
+		"account_id":          account.ID,
+		"account_type":        account.Type,
+		"account_description": account.Description,
+	}
+}
+
+type transactionsResult struct {
+	Transactions []transaction `json:"transactions"`
+}
+
+type transaction struct {
+	AccountID      string   `json:"account_id"`
+	AccountBalance int      `json:"account_balance"`
+	Amount         int      `json:"amount"`
+	CreatedTime    string   `json:"created"`
+	Currency       string   `json:"currency"`
+	Description    string   `json:"description"`
+	ID             string   `json:"id"`
+	Merchant       merchant `json:"merchant"`
+	Notes          string   `json:"notes"`
+	IsLoad         bool     `json:"is_load"`
+	Settled        string   `json:"settled"`
+	Category       string   `json:"category"`
+}
+
+type merchant struct {
+	Address struct {
+		Address   string  `json:"address"`
+		City      string  `json:"city"`
+		Country   string  `json:"country"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Postcode  string  `json:"postcode"`
+		Region    string  `json:"region"`
+	} `json:"address"`
+	Created  string `json:"created"`
+	GroupID  string `json:"group_id"`
+	ID       string `json:"id"`
+	Logo     string `json:"logo"`
+	Emoji    string `json:"emoji"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// getTransactionsPage fetches a page of transactions created within the window, after the transaction with the
+// provided ID if set. Failed requests are retried with backoff, other than those for transactions which Monzo no longer
+// allows to be fetched, which return errHistoryRestricted.
+func (m *Monzo) getTransactionsPage(ctx context.Context, accountID string, start, end time.Time,
+	sinceID string) ([]transaction, error) {
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		transactions, err := m.getTransactions(ctx, accountID, start, end, sinceID)
+		if err == nil {
+			return transactions.Transactions, nil
+		}
+		var apiErr apiError
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusForbidden &&
+			apiErr.Code == "forbidden.verification_required" {
+			return nil, errHistoryRestricted
+		}
+		if attempt == pageAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+
+		logging.Warnf("failed to get Monzo transactions page, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (m *Monzo) getTransactions(ctx context.Context, accountID string, start, end time.Time,
+	sinceID string) (transactionsResult, error) {
+
+	q := url.Values{}
+	q.Set("account_id", accountID)
+	// since accepts either a timestamp or a transaction ID to page from
+	if sinceID != "" {
+		q.Set("since", sinceID)
+	} else {
+		q.Set("since", start.Format(time.RFC3339))
+	}
+	q.Set("before", end.Format(time.RFC3339))
+	q.Set("limit", strconv.Itoa(transactionsPageLimit))
+	// enrich transaction with merchant data
+	q.Set("expand[]", "merchant")
+
+	var transactions transactionsResult
+	err := m.apiGet(ctx, "/transactions", q, &transactions)
+	return transactions, err
+}
@@ -0,0 +1,241 @@
+package monzo
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jemgunay/life-metrics/logging"
+	"github.com/jemgunay/life-metrics/sources"
+	"github.com/jemgunay/life-metrics/users"
+)
+
+const (
+	// webhookOverlap is how far before the last stored record the first resumed collection since starting re-fetches
+	// when webhooks are enabled, as transactions received by webhook before the restart may have advanced the last
+	// collected timestamp past transactions which were not delivered.
+	webhookOverlap = time.Hour * 24
+	// seenTransactionsTTL is how long received webhook transaction IDs are remembered to deduplicate redeliveries
+	seenTransactionsTTL = time.Hour * 24
+)
+
+// webhookRequest is a request for the collection goroutine to write a transaction received by webhook.
+type webhookRequest struct {
+	ctx           context.Context
+	accountID     string
+	transactionID string
+	done          chan error
+}
+
+// webhookEvent is the body of a Monzo webhook request.
+type webhookEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		ID        string `json:"id"`
+		AccountID string `json:"account_id"`
+	} `json:"data"`
+}
+
+// WebhookHandler receives transaction.created webhook events from Monzo and writes the transactions immediately.
+// Requests are verified by the secret token in the registered webhook URL, and the transaction is fetched from the
+// Monzo API rather than trusting the event body.
+func (m *Monzo) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if m.webhookSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.webhookSecret)) != 1 {
+		logging.Warnf("rejected Monzo webhook request with invalid token from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var event webhookEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&event); err != nil {
+		logging.Errorf("failed to JSON decode Monzo webhook request body: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if event.Type != "transaction.created" {
+		logging.Debugf("ignoring Monzo webhook event of type %s", event.Type)
+		return
+	}
+	if event.Data.ID == "" || event.Data.AccountID == "" {
+		logging.Warnf("Monzo webhook event has no transaction or account ID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := webhookRequest{
+		ctx:           r.Context(),
+		accountID:     event.Data.AccountID,
+		transactionID: event.Data.ID,
+		done:          make(chan error, 1),
+	}
+	select {
+	case m.webhookChan <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	// a failed response causes Monzo to retry the webhook
+	if err := <-req.done; err != nil {
+		logging.Errorf("failed to process Monzo webhook transaction %s: %s", event.Data.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// receiveTransaction fetches and writes a transaction received by webhook, unless it has already been received.
+func (m *Monzo) receiveTransaction(ctx context.Context, accountID, transactionID string) error {
+	now := time.Now()
+	for id, seen := range m.seenTransactions {
+		if now.Sub(seen) > seenTransactionsTTL {
+			delete(m.seenTransactions, id)
+		}
+	}
+	if _, ok := m.seenTransactions[transactionID]; ok {
+		return nil
+	}
+
+	accounts, err := m.getAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get accounts: %s", err)
+	}
+	for _, account := range accounts {
+		if account.ID != accountID {
+			continue
+		}
+
+		q := url.Values{}
+		// enrich transaction with merchant data, matching polled transactions so that they overwrite the same point
+		q.Set("expand[]", "merchant")
+		var res struct {
+			Transaction transaction `json:"transaction"`
+		}
+		if err := m.apiGet(ctx, "/transactions/"+url.PathEscape(transactionID), q, &res); err != nil {
+			return fmt.Errorf("failed to get transaction: %s", err)
+		}
+		if res.Transaction.AccountID != accountID {
+			return fmt.Errorf("transaction belongs to account %s rather than %s", res.Transaction.AccountID, accountID)
+		}
+
+		if _, err := m.writeTransactions(account, []transaction{res.Transaction}); err != nil {
+			return err
+		}
+		m.seenTransactions[transactionID] = now
+		if created, err := time.Parse(time.RFC3339, res.Transaction.CreatedTime); err == nil &&
+			created.After(m.lastWebhookTransaction) {
+			m.lastWebhookTransaction = created
+		}
+		return nil
+	}
+
+	// the account isn't collected
+	return nil
+}
+
+// webhookCollectionStart returns the start of a collection when webhooks are enabled. Transactions received by webhook
+// advance the last collected timestamp, so if any have been received since the end of the last complete collection,
+// the collection starts from there instead so that any transactions which were not delivered by webhook are collected.
+// The first collection since starting re-fetches the overlap, as the end of the last complete collection is unknown.
+// Only collections resumed from the last stored record are adjusted; explicit and reset starts are collected as given.
+func (m *Monzo) webhookCollectionStart(period sources.Period) time.Time {
+	switch {
+	case !period.Resumed:
+		return period.Start
+	case m.collectedUntil.IsZero():
+		return period.Start.Add(-webhookOverlap)
+	case m.lastWebhookTransaction.After(m.collectedUntil) && m.collectedUntil.Before(period.Start):
+		return m.collectedUntil
+	}
+	return period.Start
+}
+
+// registerWebhooks registers the webhook URL for each collected account which doesn't already have it registered.
+func (m *Monzo) registerWebhooks(ctx context.Context) error {
+	accounts, err := m.getAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get accounts: %s", err)
+	}
+
+	for _, account := range accounts {
+		q := url.Values{}
+		q.Set("account_id", account.ID)
+		var webhooks struct {
+			Webhooks []struct {
+				URL string `json:"url"`
+			} `json:"webhooks"`
+		}
+		if err := m.apiGet(ctx, "/webhooks", q, &webhooks); err != nil {
+			return fmt.Errorf("failed to list webhooks for account %s: %s", account.ID, err)
+		}
+
+		registered := false
+		for _, webhook := range webhooks.Webhooks {
+			if webhook.URL == m.webhookURL() {
+				registered = true
+				break
+			}
+		}
+		if registered {
+			continue
+		}
+
+		if err := m.registerWebhook(ctx, account.ID); err != nil {
+			return fmt.Errorf("failed to register webhook for account %s: %s", account.ID, err)
+		}
+		logging.Infof("registered Monzo webhook for account %s", account.ID)
+	}
+
+	return nil
+}
+
+func (m *Monzo) registerWebhook(ctx context.Context, accountID string) error {
+	form := url.Values{}
+	form.Set("account_id", accountID)
+	form.Set("url", m.webhookURL())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.apiURL+"/webhooks",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+m.currentAuth.AccessToken)
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform webhook request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("non-200 status for webhook request: %s, body: %s", resp.Status, b)
+	}
+	return nil
+}
+
+// webhookURL is the URL Monzo sends webhook events to, which includes the secret token used to verify them and the
+// ID of the user they are for.
+func (m *Monzo) webhookURL() string {
+	q := url.Values{}
+	q.Set("token", m.webhookSecret)
+	if m.user != users.DefaultID {
+		q.Set("user", m.user)
+	}
+	return m.serviceWebhookURL + "?" + q.Encode()
+}
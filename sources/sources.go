@@ -1,13 +1,17 @@
 package sources
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Source defines the requirements for a data collection source.
 type Source interface {
 	// Name returns the name of the source.
 	Name() string
-	// Collect collects data for a given time period.
-	Collect(period Period)
+	// Collect collects and exports data for a given time period, blocking until complete or until the context is
+	// done. It returns the number of records collected.
+	Collect(ctx context.Context, period Period) (int, error)
 	// StateSet returns current source state to be displayed on the sources page.
 	State() StateSet
 }
@@ -31,6 +35,8 @@ type Result struct {
 type Period struct {
 	Start time.Time
 	End   time.Time
+	// Resumed is set when Start follows the last stored record, rather than being requested explicitly or reset.
+	Resumed bool
 }
 
 // NewPeriod creates a new Period given a start and end time.
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/jemgunay/life-metrics/metrics"
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+var (
+	writeDuration = metrics.NewHistogram("life_metrics_storage_write_duration_seconds",
+		"Time taken to write to the storage backend, by backend.", metrics.DefBuckets, "backend")
+	writeErrors = metrics.NewCounter("life_metrics_storage_write_errors_total",
+		"Failed writes to the storage backend, by backend and measurement.", "backend", "measurement")
+	recordsWritten = metrics.NewCounter("life_metrics_storage_records_written_total",
+		"Records written to the storage backend, by backend and measurement.", "backend", "measurement")
+	newestRecordAge = metrics.NewAgeGauge("life_metrics_newest_record_age_seconds",
+		"Seconds since the time of the newest record stored, by measurement and user.", "measurement", "user")
+)
+
+// instrumentedStore records metrics for the writes to the store that it wraps, and tracks the newest record stored
+// for each measurement and user.
+type instrumentedStore struct {
+	Store
+	backend string
+	user    string
+}
+
+// Instrument wraps a store, recording metrics under the backend's name.
+func Instrument(store Store, backend string) Store {
+	return instrumentedStore{
+		Store:   store,
+		backend: backend,
+	}
+}
+
+// Write writes the results to the wrapped store.
+func (s instrumentedStore) Write(measurement string, results ...sources.Result) error {
+	if len(results) == 0 {
+		return s.Store.Write(measurement, results...)
+	}
+
+	start := time.Now()
+	err := s.Store.Write(measurement, results...)
+	writeDuration.ObserveDuration(start, s.backend)
+	if err != nil {
+		writeErrors.Inc(s.backend, measurement)
+		return err
+	}
+
+	recordsWritten.Add(float64(len(results)), s.backend, measurement)
+	for _, result := range results {
+		// results written via the unscoped store, e.g. by the outbox, are already tagged with their user
+		user := s.user
+		if tagged, ok := result.Tags[UserTag]; ok {
+			user = tagged
+		}
+		newestRecordAge.SetMaxTime(result.Time, measurement, user)
+	}
+	return nil
+}
+
+// LastTimestampByMeasurement gets the timestamp of the most recent record for the measurement from the wrapped store.
+// This also tracks records stored before the service started, as collections read the last timestamp on start.
+func (s instrumentedStore) LastTimestampByMeasurement(measurement string) (time.Time, error) {
+	t, err := s.Store.LastTimestampByMeasurement(measurement)
+	if err == nil {
+		newestRecordAge.SetMaxTime(t, measurement, s.user)
+	}
+	return t, err
+}
+
+// ForUser returns an instrumented view of the wrapped store scoped to the user.
+func (s instrumentedStore) ForUser(userID string) Store {
+	return instrumentedStore{
+		Store:   s.Store.ForUser(userID),
+		backend: s.backend,
+		user:    userID,
+	}
+}
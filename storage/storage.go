@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jemgunay/life-metrics/sources"
+)
+
+// Store defines the requirements for a storage backend which persists and queries collected data, e.g. InfluxDB.
+type Store interface {
+	sources.Exporter
+	// ReadDayLog reads the day log fields submitted for the day containing the provided time.
+	ReadDayLog(day time.Time) (map[string]interface{}, error)
+	// ReadRange reads all results for the given measurement which fall within the provided period, ordered by time.
+	ReadRange(measurement string, period sources.Period) ([]sources.Result, error)
+	// LastTimestampByMeasurement gets the timestamp associated with the most recent record for the given measurement.
+	LastTimestampByMeasurement(measurement string) (time.Time, error)
+	// Delete deletes all results for the given measurement which fall within the provided period.
+	Delete(measurement string, period sources.Period) error
+	// ForUser returns a view of the store scoped to the user with the provided ID. Results written via the view are
+	// tagged with the user, and only the user's results are read or deleted via it. The default user's view is
+	// unscoped.
+	ForUser(userID string) Store
+	// Close releases the resources held by the store once it is no longer in use.
+	Close() error
+}
+
+// ErrNoResults indicates that there are no results for the executed query.
+var ErrNoResults = errors.New("no results for query")
+
+// ErrRejected indicates that the store rejected a write which will fail however many times it is retried, e.g. due to
+// a field type conflict.
+var ErrRejected = errors.New("write rejected")
+
+// UserTag is the tag which identifies the user that a result belongs to.
+const UserTag = "user"
+
+// WithUser returns copies of the results tagged with the user ID. Results are returned unchanged for the default user,
+// which has an empty ID.
+func WithUser(userID string, results []sources.Result) []sources.Result {
+	if userID == "" {
+		return results
+	}
+
+	tagged := make([]sources.Result, 0, len(results))
+	for _, result := range results {
+		tags := make(map[string]string, len(result.Tags)+1)
+		for k, v := range result.Tags {
+			tags[k] = v
+		}
+		tags[UserTag] = userID
+		result.Tags = tags
+		tagged = append(tagged, result)
+	}
+	return tagged
+}
+
+// UserExporter wraps an exporter, tagging results with the user ID before they are written.
+func UserExporter(exporter sources.Exporter, userID string) sources.Exporter {
+	return userExporter{
+		exporter: exporter,
+		userID:   userID,
+	}
+}
+
+type userExporter struct {
+	exporter sources.Exporter
+	userID   string
+}
+
+func (e userExporter) Write(measurement string, results ...sources.Result) error {
+	return e.exporter.Write(measurement, WithUser(e.userID, results)...)
+}
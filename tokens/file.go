@@ -0,0 +1,91 @@
+package tokens
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is a Store which persists each source's token to an AES-GCM encrypted file in a directory.
+type File struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// NewFile initialises a File store in the provided directory. Tokens are encrypted with a key derived from the
+// provided secret, so the same secret must be provided to load tokens after a restart.
+func NewFile(dir, secret string) (*File, error) {
+	if secret == "" {
+		return nil, errors.New("no encryption secret provided")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create token directory: %s", err)
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM cipher: %s", err)
+	}
+
+	return &File{
+		dir:  dir,
+		aead: aead,
+	}, nil
+}
+
+// Load reads and decrypts the token file for the named source.
+func (f *File) Load(source string) ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path(source))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %s", err)
+	}
+
+	nonceSize := f.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("token file is truncated")
+	}
+
+	// the source name is authenticated so that one source's token file cannot be swapped for another's
+	token, err := f.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(source))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file, the encryption secret may have changed: %s", err)
+	}
+	return token, nil
+}
+
+// Save encrypts and atomically writes the token file for the named source.
+func (f *File) Save(source string, token []byte) error {
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %s", err)
+	}
+	data := f.aead.Seal(nonce, nonce, token, []byte(source))
+
+	path := f.path(source)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write token file: %s", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace token file: %s", err)
+	}
+	return nil
+}
+
+func (f *File) path(source string) string {
+	return filepath.Join(f.dir, source+".token")
+}
@@ -0,0 +1,28 @@
+package tokens
+
+import "errors"
+
+// Store defines the requirements for persisting source OAuth tokens, so that sources remain authenticated across
+// restarts. Tokens are opaque to the Store and are keyed by source name.
+type Store interface {
+	// Load loads the token for the named source, returning ErrNotFound if none has been saved.
+	Load(source string) ([]byte, error)
+	// Save saves the token for the named source, replacing any existing token.
+	Save(source string, token []byte) error
+}
+
+// ErrNotFound indicates that no token has been saved for a source.
+var ErrNotFound = errors.New("token not found")
+
+// Nop is a Store which does not persist tokens.
+type Nop struct{}
+
+// Load always returns ErrNotFound.
+func (Nop) Load(string) ([]byte, error) {
+	return nil, ErrNotFound
+}
+
+// Save discards the token.
+func (Nop) Save(string, []byte) error {
+	return nil
+}
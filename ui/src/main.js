@@ -1,9 +1,11 @@
 import "bootstrap";
 import "bootstrap/dist/css/bootstrap.min.css";
+import axios from "axios";
 import { createApp } from "vue";
 import { createRouter, createWebHistory } from "vue-router";
 import App from "./App.vue";
 import DayLogPage from "./components/pages/DayLogPage.vue";
+import LoginPage from "./components/pages/LoginPage.vue";
 import SourcesPage from "./components/pages/SourcesPage.vue";
 
 const routes = [
@@ -16,6 +18,11 @@ const routes = [
         path: "/sources",
         name: "sources",
         component: SourcesPage
+    },
+    {
+        path: "/login",
+        name: "login",
+        component: LoginPage
     }
 ];
 
@@ -24,6 +31,16 @@ const router = createRouter({
     routes: routes
 });
 
+// send the session cookie with API requests, and log in when the session is missing or has expired
+axios.defaults.withCredentials = true;
+axios.interceptors.response.use(undefined, (error) => {
+    const route = router.currentRoute.value;
+    if (error.response && error.response.status === 401 && route.name !== "login") {
+        router.push({ name: "login", query: { redirect: route.fullPath } });
+    }
+    return Promise.reject(error);
+});
+
 import { library } from "@fortawesome/fontawesome-svg-core";
 import { faCheckCircle, faTimesCircle } from "@fortawesome/free-solid-svg-icons";
 import { FontAwesomeIcon } from "@fortawesome/vue-fontawesome";
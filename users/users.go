@@ -0,0 +1,122 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/jemgunay/life-metrics/config"
+)
+
+// DefaultID is the ID of the default user, which is the only user if no users file is provided. The default user's
+// data is stored without a user tag, as it was before multiple users were supported.
+const DefaultID = ""
+
+// idPattern restricts user IDs to characters which are safe to use in storage queries, paths and URLs.
+var idPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// User is a user of the service. Each user's data and source credentials are isolated from every other user's.
+type User struct {
+	ID string `yaml:"id"`
+	// Password is the web app login password - session login is disabled for the user if unset.
+	Password string `yaml:"password"`
+	// APITokens are the bearer tokens which authenticate machine callers as the user.
+	APITokens []string `yaml:"api_tokens"`
+	// Monzo overrides the Monzo OAuth client credentials for the user.
+	Monzo Monzo `yaml:"monzo"`
+	// Timezone is the IANA timezone that the user's day logs are bucketed into days in, e.g. America/New_York - the
+	// configured timezone is used if unset.
+	Timezone string `yaml:"timezone"`
+	// Location is the loaded Timezone, or the configured timezone's location if unset.
+	Location *time.Location `yaml:"-"`
+}
+
+// Monzo contains a user's Monzo OAuth client credentials. The credentials set in the Monzo config are used if unset.
+type Monzo struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+// Secrets returns the user's secret values, which must never be logged.
+func (u User) Secrets() []string {
+	return append([]string{u.Password, u.Monzo.ClientSecret}, u.APITokens...)
+}
+
+type usersFile struct {
+	Users []User `yaml:"users"`
+}
+
+// Load reads and validates a YAML users file. If no path is provided, the default user is returned with the
+// credentials set in the auth config. Users without a timezone use the provided location.
+func Load(path string, conf config.Auth, loc *time.Location) ([]User, error) {
+	if path == "" {
+		return []User{{
+			ID:        DefaultID,
+			Password:  conf.Password,
+			APITokens: conf.APITokens,
+			Location:  loc,
+		}}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %s", err)
+	}
+
+	var f usersFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to YAML decode users file: %s", err)
+	}
+
+	if err := validate(f.Users); err != nil {
+		return nil, fmt.Errorf("invalid users file: %s", err)
+	}
+
+	for i, user := range f.Users {
+		f.Users[i].Location = loc
+		if user.Timezone == "" {
+			continue
+		}
+		if f.Users[i].Location, err = time.LoadLocation(user.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid users file: user %s has unknown timezone %q", user.ID, user.Timezone)
+		}
+	}
+	return f.Users, nil
+}
+
+// validate checks that every user has a unique, valid ID and can be authenticated by credentials unique to them.
+func validate(users []User) error {
+	if len(users) == 0 {
+		return errors.New("no users defined")
+	}
+
+	ids := make(map[string]bool, len(users))
+	tokens := make(map[string]bool)
+	for _, user := range users {
+		if !idPattern.MatchString(user.ID) {
+			return fmt.Errorf("user ID %q must be 1 to 32 lowercase letters, digits, underscores or hyphens", user.ID)
+		}
+		if ids[user.ID] {
+			return fmt.Errorf("duplicate user ID %q", user.ID)
+		}
+		ids[user.ID] = true
+
+		if user.Password == "" && len(user.APITokens) == 0 {
+			return fmt.Errorf("user %s has no password or API tokens", user.ID)
+		}
+		for _, token := range user.APITokens {
+			if token == "" {
+				return fmt.Errorf("user %s has an empty API token", user.ID)
+			}
+			if tokens[token] {
+				return fmt.Errorf("user %s has an API token which is already in use", user.ID)
+			}
+			tokens[token] = true
+		}
+	}
+	return nil
+}